@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/text"
+)
+
+// Samples further apart than this are not integrated, the device was
+// probably offline in between.
+const maxIntegrationGap = time.Minute
+
+// EnergyAccounting integrates power samples into kWh and cost per device
+// and day.
+type EnergyAccounting struct {
+	mu   sync.Mutex
+	days map[string]map[string]*energyTotals // date -> device -> totals
+	// Set by load, saving before would overwrite the saved totals
+	loaded bool
+}
+
+type energyTotals struct {
+	KWh  float64
+	Cost float64
+}
+
+func dateKey(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// add integrates the segment between two samples of a device (trapezoid).
+func (a *EnergyAccounting) add(device string, prevAt, at time.Time, prevWatts, watts float64) {
+	dt := at.Sub(prevAt)
+	if dt <= 0 || dt > maxIntegrationGap {
+		return
+	}
+	kWh := (prevWatts + watts) / 2 * dt.Hours() / 1000
+	a.addEnergy(device, at, kWh, kWh*config.Energy.Tariff.price(at))
+}
+
+func (a *EnergyAccounting) addEnergy(device string, at time.Time, kWh, cost float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.days == nil {
+		a.days = map[string]map[string]*energyTotals{}
+	}
+	day := a.days[dateKey(at)]
+	if day == nil {
+		day = map[string]*energyTotals{}
+		a.days[dateKey(at)] = day
+	}
+	t := day[device]
+	if t == nil {
+		t = &energyTotals{}
+		day[device] = t
+	}
+	t.KWh += kWh
+	t.Cost += cost
+}
+
+// Totals sums all devices over the days in [from, to) and adds the base fee
+// of those days.
+func (a *EnergyAccounting) Totals(from, to time.Time) energyTotals {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var res energyTotals
+	for day := startOfDay(from); day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, t := range a.days[dateKey(day)] {
+			res.KWh += t.KWh
+			res.Cost += t.Cost
+		}
+		res.Cost += config.Energy.Tariff.baseFeePerDay(day)
+	}
+	return res
+}
+
+// DeviceTotals sums each device over the days in [from, to).
+func (a *EnergyAccounting) DeviceTotals(from, to time.Time) map[string]energyTotals {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res := map[string]energyTotals{}
+	for day := startOfDay(from); day.Before(to); day = day.AddDate(0, 0, 1) {
+		for device, t := range a.days[dateKey(day)] {
+			r := res[device]
+			r.KWh += t.KWh
+			r.Cost += t.Cost
+			res[device] = r
+		}
+	}
+	return res
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func startOfWeek(t time.Time) time.Time {
+	offset := (int(t.Weekday()) + 6) % 7 // monday
+	return startOfDay(t).AddDate(0, 0, -offset)
+}
+
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+func (a *EnergyAccounting) Today() energyTotals {
+	now := time.Now()
+	return a.Totals(startOfDay(now), startOfDay(now).AddDate(0, 0, 1))
+}
+
+func (a *EnergyAccounting) Yesterday() energyTotals {
+	today := startOfDay(time.Now())
+	return a.Totals(today.AddDate(0, 0, -1), today)
+}
+
+func (a *EnergyAccounting) Week() energyTotals {
+	now := time.Now()
+	return a.Totals(startOfWeek(now), startOfDay(now).AddDate(0, 0, 1))
+}
+
+func (a *EnergyAccounting) Month() energyTotals {
+	now := time.Now()
+	return a.Totals(startOfMonth(now), startOfDay(now).AddDate(0, 0, 1))
+}
+
+// serveTotals handles GET /energy/totals with kWh and cost per device for
+// today, yesterday, this week and this month.
+func (a *EnergyAccounting) serveTotals(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	today := startOfDay(now)
+	tomorrow := today.AddDate(0, 0, 1)
+
+	type period struct {
+		Total   energyTotals
+		Devices map[string]energyTotals
+	}
+	get := func(from, to time.Time) period {
+		return period{Total: a.Totals(from, to), Devices: a.DeviceTotals(from, to)}
+	}
+
+	writeJson(w, map[string]any{
+		"currency":  config.Energy.Tariff.Currency,
+		"today":     get(today, tomorrow),
+		"yesterday": get(today.AddDate(0, 0, -1), today),
+		"week":      get(startOfWeek(now), tomorrow),
+		"month":     get(startOfMonth(now), tomorrow),
+	})
+}
+
+type CostUi struct {
+	screen *ebiten.Image
+}
+
+func (ui *CostUi) Init() {
+	width, height := ui.Bounds()
+	ui.screen = ebiten.NewImage(width, height)
+}
+
+func (ui *CostUi) Bounds() (width, height int) {
+	return config.Width, (fontHeight+linePadding)*5 + linePadding*4
+}
+
+func (ui *CostUi) Draw() *ebiten.Image {
+	ui.screen.Fill(bgColor)
+
+	a := &energyService.accounting
+	currency := config.Energy.Tariff.Currency
+	lines := []struct {
+		label  string
+		totals energyTotals
+	}{
+		{"today", a.Today()},
+		{"yesterday", a.Yesterday()},
+		{"month", a.Month()},
+	}
+
+	text.Draw(ui.screen, "energy cost", defaultFont, 0, fontHeight, textColor)
+	for i, l := range lines {
+		y := (fontHeight + linePadding) * (i + 2)
+		text.Draw(ui.screen, l.label, defaultFont, 0, y, textColor)
+		text.Draw(
+			ui.screen,
+			fmt.Sprintf("%.2f%s  %.1fkwh", l.totals.Cost, currency, l.totals.KWh),
+			defaultFont,
+			fontWidth*6,
+			y,
+			textColor,
+		)
+	}
+
+	y := (fontHeight + linePadding) * (len(lines) + 2)
+	text.Draw(ui.screen, "now", defaultFont, 0, y, textColor)
+	text.Draw(
+		ui.screen,
+		fmt.Sprintf("%.3f%s/kwh", config.Energy.Tariff.price(time.Now()), currency),
+		defaultFont,
+		fontWidth*6,
+		y,
+		textColor,
+	)
+
+	return ui.screen
+}
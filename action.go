@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (a AutomationAction) String() string {
+	switch a.Type {
+	case AutomationActionPlug:
+		return fmt.Sprintf("plug %s=%v", a.DeviceUUID, a.State)
+	case AutomationActionMqtt:
+		return fmt.Sprintf("mqtt %s", a.Topic)
+	case AutomationActionWebhook:
+		return fmt.Sprintf("webhook %s", a.URL)
+	case AutomationActionAlert:
+		return "alert"
+	case AutomationActionSound:
+		return fmt.Sprintf("sound %s", a.File)
+	}
+	return string(a.Type)
+}
+
+// Execute runs the action once. Retrying is left to the caller.
+func (a AutomationAction) Execute() error {
+	switch a.Type {
+	case AutomationActionPlug:
+		device := findEnergyDevice(a.DeviceUUID)
+		if device == nil {
+			return fmt.Errorf("device %s not found", a.DeviceUUID)
+		}
+		return device.SetPlugState(a.State)
+
+	case AutomationActionMqtt:
+		return mqttService.Publish(a.Topic, a.Payload, a.Retain)
+
+	case AutomationActionWebhook:
+		method := a.Method
+		if method == "" {
+			method = http.MethodPost
+		}
+		req, err := http.NewRequest(method, a.URL, strings.NewReader(a.Body))
+		if err != nil {
+			return err
+		}
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("webhook %s failed: %d: %s", a.URL, resp.StatusCode, string(body))
+		}
+		return nil
+
+	case AutomationActionAlert:
+		d := time.Duration(a.Duration) * time.Second
+		if d == 0 {
+			d = 20 * time.Second
+		}
+		showAlert(a.Message, d)
+		return nil
+
+	case AutomationActionSound:
+		file := a.File
+		if file == "" {
+			file = "./assets/alaram.mp3"
+		}
+		return playSound(file)
+	}
+
+	return fmt.Errorf("unknown action type %q", a.Type)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"image/color"
+	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/text"
@@ -33,3 +34,27 @@ func (ui *AlertUi) Draw() *ebiten.Image {
 
 	return ui.screen
 }
+
+// showAlert opens a modal with msg on top of the current layout and removes it
+// again after d, unless another modal replaced it in the meantime.
+func showAlert(msg string, d time.Duration) {
+	m := &ModalUi{
+		stackLayout: []UiElement{
+			&AlertUi{
+				msg: msg,
+			},
+		},
+	}
+	m.Init()
+	game.currentModal.Set(m)
+
+	go func() {
+		time.Sleep(d)
+		game.currentModal.Update(func(current UiElement) UiElement {
+			if current == m {
+				return nil
+			}
+			return current
+		})
+	}()
+}
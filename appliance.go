@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of finished cycles kept in cycles.json
+const maxApplianceCycles = 500
+
+// ApplianceCycle is one finished run of an appliance.
+type ApplianceCycle struct {
+	Appliance string    `json:"appliance"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Seconds   float64   `json:"seconds"`
+	KWh       float64   `json:"kwh"`
+	Cost      float64   `json:"cost"`
+}
+
+// ApplianceService detects appliance cycles from the samples of the energy
+// service.
+type ApplianceService struct {
+	mu     sync.Mutex
+	cycles []ApplianceCycle
+}
+
+type applianceMonitor struct {
+	cfg ApplianceConfig
+
+	mu          sync.Mutex
+	running     bool
+	start       time.Time
+	belowSince  time.Time
+	lastAt      time.Time
+	lastWatts   float64
+	kWh         float64
+	cost        float64
+	onFinished  func(ApplianceCycle)
+	onRunning   func(bool)
+	idleTimeout time.Duration
+}
+
+func (s *ApplianceService) Run() {
+	s.load()
+	httpService.HandleFunc("/energy/cycles", s.serveCycles)
+
+	for _, cfg := range config.Energy.Appliances {
+		d := energyService.device(cfg.Device)
+		if d == nil {
+			d = energyService.deviceByName(cfg.Device)
+		}
+		if d == nil {
+			log.Printf("appliance %s: device %s not found", cfg.Name, cfg.Device)
+			continue
+		}
+
+		m := &applianceMonitor{
+			cfg:         cfg,
+			idleTimeout: time.Duration(cfg.IdleSeconds) * time.Second,
+			onFinished: func(c ApplianceCycle) {
+				s.finished(cfg, c)
+			},
+			onRunning: func(running bool) {
+				s.publishState(cfg.Name, running)
+			},
+		}
+		if m.idleTimeout == 0 {
+			m.idleTimeout = 180 * time.Second
+		}
+		d.history.OnChange(m.sample)
+	}
+}
+
+// sample feeds the newest sample of h into the cycle detection.
+func (m *applianceMonitor) sample(h EnergyHistory) {
+	n := len(h.timestamps)
+	if n == 0 {
+		return
+	}
+	at, watts := h.timestamps[n-1], h.aggregated[n-1]
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Skip repeated snapshots and history loaded at startup
+	if !at.After(m.lastAt) || time.Since(at) > maxIntegrationGap {
+		return
+	}
+	if m.running {
+		if dt := at.Sub(m.lastAt); dt <= maxIntegrationGap {
+			kWh := (m.lastWatts + watts) / 2 * dt.Hours() / 1000
+			m.kWh += kWh
+			m.cost += kWh * config.Energy.Tariff.price(at)
+		}
+	}
+	m.lastAt, m.lastWatts = at, watts
+
+	switch {
+	case !m.running && watts >= m.cfg.StartWatts:
+		m.running = true
+		m.start = at
+		m.belowSince = time.Time{}
+		m.kWh, m.cost = 0, 0
+		go m.onRunning(true)
+
+	case m.running && watts >= m.cfg.IdleWatts:
+		m.belowSince = time.Time{}
+
+	case m.running && m.belowSince.IsZero():
+		m.belowSince = at
+
+	case m.running && at.Sub(m.belowSince) >= m.idleTimeout:
+		m.running = false
+		go m.onRunning(false)
+
+		duration := m.belowSince.Sub(m.start)
+		if duration < time.Duration(m.cfg.MinDurationSeconds)*time.Second {
+			return
+		}
+		go m.onFinished(ApplianceCycle{
+			Appliance: m.cfg.Name,
+			Start:     m.start,
+			End:       m.belowSince,
+			Seconds:   duration.Seconds(),
+			KWh:       m.kWh,
+			Cost:      m.cost,
+		})
+	}
+}
+
+// finished records c, shows the appliance message and publishes the cycle to
+// screen-app/appliance/<name>/cycle.
+func (s *ApplianceService) finished(cfg ApplianceConfig, c ApplianceCycle) {
+	duration := (time.Duration(c.Seconds) * time.Second).Round(time.Minute)
+	log.Printf("appliance %s: cycle finished after %s, %.2fkWh", c.Appliance, duration, c.KWh)
+
+	s.mu.Lock()
+	s.cycles = append(s.cycles, c)
+	if len(s.cycles) > maxApplianceCycles {
+		s.cycles = s.cycles[len(s.cycles)-maxApplianceCycles:]
+	}
+	s.mu.Unlock()
+	s.save()
+
+	msg := cfg.Message
+	if msg == "" {
+		msg = fmt.Sprintf("%s done", c.Appliance)
+	}
+	showAlert(
+		strings.ToLower(fmt.Sprintf("%s\n%s %.2fkwh", msg, duration, c.KWh)),
+		time.Minute,
+	)
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		log.Println("Could not encode appliance cycle:", err)
+		return
+	}
+	topic := fmt.Sprintf("screen-app/appliance/%s/cycle", c.Appliance)
+	if err := mqttService.Publish(topic, string(b), true); err != nil {
+		log.Printf("appliance %s: could not publish cycle: %v", c.Appliance, err)
+	}
+}
+
+// publishState publishes "running" or "idle" to
+// screen-app/appliance/<name>/state and appliance:<name> for automations.
+func (s *ApplianceService) publishState(name string, running bool) {
+	state, v := "idle", 0.0
+	if running {
+		state, v = "running", 1
+	}
+	derivedValues.Publish("appliance:"+name, v)
+
+	topic := fmt.Sprintf("screen-app/appliance/%s/state", name)
+	if err := mqttService.Publish(topic, state, true); err != nil {
+		log.Printf("appliance %s: could not publish state: %v", name, err)
+	}
+}
+
+// serveCycles handles GET /energy/cycles.
+func (s *ApplianceService) serveCycles(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	cycles := append([]ApplianceCycle(nil), s.cycles...)
+	s.mu.Unlock()
+	writeJson(w, cycles)
+}
+
+func cyclesPath() string {
+	return filepath.Join(config.Storage.Path, "cycles.json")
+}
+
+func (s *ApplianceService) load() {
+	b, err := os.ReadFile(cyclesPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Could not load appliance cycles:", err)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := json.Unmarshal(b, &s.cycles); err != nil {
+		log.Println("Could not load appliance cycles:", err)
+	}
+}
+
+func (s *ApplianceService) save() {
+	s.mu.Lock()
+	b, err := json.Marshal(s.cycles)
+	s.mu.Unlock()
+	if err != nil {
+		log.Println("Could not save appliance cycles:", err)
+		return
+	}
+	if err := writeFileAtomic(cyclesPath(), b); err != nil {
+		log.Println("Could not save appliance cycles:", err)
+	}
+}
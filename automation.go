@@ -1,47 +1,75 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"strconv"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 type AutomationService struct {
+	mu      sync.Mutex
 	states  map[string]*automationState
+	list    []*automationState // config order
 	byTopic map[string][]*automationState
+	byInput map[string][]*automationState
+	started time.Time
+
+	// simulate records switches into events instead of running actions and
+	// leaves deferred switches to the caller (see runPending)
+	simulate bool
+	events   []automationEvent
+}
+
+type automationEvent struct {
+	at        time.Time
+	name      string
+	triggered bool
+	on        bool
 }
 
 type automationState struct {
-	cfg        AutomationConfig
-	device     *RefossEnergyDeviceConfig
-	triggered  bool
-	haveSample bool
+	cfg       AutomationConfig
+	onTrigger []AutomationAction
+	onRelease []AutomationAction
+	// onState is the value of triggered that means the device is on
+	onState   bool
+	triggered bool
+
+	lastSample time.Time
+	lastValue  float64
+	haveValue  bool
+	stale      bool
+
+	// Manual override, control returns to the automation after overrideUntil
+	overrideOn    bool
+	overrideUntil time.Time
+
+	// controller is set for duty-cycle automations
+	controller *dutyCycleController
+
+	// applied is the last state whose actions ran
+	applied     bool
+	haveApplied bool
+	lastSwitch  time.Time
+	toggles     []time.Time
+	pending     *time.Timer
+	// pendingAt is the time a deferred switch is due, zero if none
+	pendingAt time.Time
+
+	// generation is bumped on every edge so retries of an outdated edge stop
+	generation int
+	lastErr    error
+	lastErrAt  time.Time
 }
 
 func (s *AutomationService) Run() {
 	mqttService.WaitReady()
 
-	s.states = map[string]*automationState{}
-	s.byTopic = map[string][]*automationState{}
-
-	for _, cfg := range config.Automations {
-		var device *RefossEnergyDeviceConfig
-		for i := range config.Energy.Devices {
-			if config.Energy.Devices[i].UUID == cfg.DeviceUUID {
-				device = &config.Energy.Devices[i]
-				break
-			}
-		}
-		if device == nil {
-			log.Printf("automation %s: device with UUID %s not found", cfg.Name, cfg.DeviceUUID)
-			continue
-		}
-
-		st := &automationState{cfg: cfg, device: device}
-		s.states[cfg.Name] = st
-		s.byTopic[cfg.Topic] = append(s.byTopic[cfg.Topic], st)
-	}
+	s.init(config.Automations, time.Now())
 
 	for topic, sts := range s.byTopic {
 		t := topic
@@ -54,6 +82,95 @@ func (s *AutomationService) Run() {
 			s.handleMessage(t, msg.Payload())
 		})
 	}
+
+	for _, st := range s.list {
+		name := st.cfg.Name
+		mqttService.On(fmt.Sprintf("screen-app/automation/%s/override", name), func(client mqtt.Client, msg mqtt.Message) {
+			if err := s.handleOverrideCommand(name, string(msg.Payload())); err != nil {
+				log.Printf("automation %s: override command: %v", name, err)
+			}
+		})
+	}
+	httpService.HandleFunc("/automations", s.serveStatus)
+	httpService.HandleFunc("/automations/", s.serveOverride)
+
+	for input, sts := range s.byInput {
+		in := input
+		log.Printf("automation: subscribing to input %s for %d automations", in, len(sts))
+		derivedValues.On(in, func(value float64) {
+			s.handleValue(s.byInput[in], value)
+		})
+	}
+
+	for now := range time.Tick(time.Second) {
+		s.checkStale(now)
+		s.tick(now)
+	}
+}
+
+// init builds the automation states from cfgs. started is the reference for
+// the startup grace period.
+func (s *AutomationService) init(cfgs []AutomationConfig, started time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.started = started
+	s.states = map[string]*automationState{}
+	s.list = nil
+	s.byTopic = map[string][]*automationState{}
+	s.byInput = map[string][]*automationState{}
+
+	for _, cfg := range cfgs {
+		st := &automationState{
+			cfg:        cfg,
+			onTrigger:  cfg.OnTriggerActions,
+			onRelease:  cfg.OnReleaseActions,
+			lastSample: started,
+		}
+
+		// Legacy single plug config
+		if len(st.onTrigger) == 0 && len(st.onRelease) == 0 && cfg.DeviceUUID != "" {
+			if findEnergyDevice(cfg.DeviceUUID) == nil {
+				log.Printf("automation %s: device %s not found", cfg.Name, cfg.DeviceUUID)
+				continue
+			}
+			st.onTrigger = []AutomationAction{{Type: AutomationActionPlug, DeviceUUID: cfg.DeviceUUID, State: cfg.OnTrigger}}
+			st.onRelease = []AutomationAction{{Type: AutomationActionPlug, DeviceUUID: cfg.DeviceUUID, State: !cfg.OnTrigger}}
+		}
+		st.onState = onEdge(st.onTrigger, st.onRelease)
+		if st.cfg.Retries == 0 {
+			st.cfg.Retries = 3
+		}
+		if cfg.Kind == AutomationKindDutyCycle {
+			if st.cfg.CycleSeconds == 0 {
+				st.cfg.CycleSeconds = 600
+			}
+			st.controller = &dutyCycleController{}
+		}
+		if cfg.Kind == AutomationKindCheapest {
+			_, ok1 := parseClock(cfg.WindowStart)
+			_, ok2 := parseClock(cfg.WindowEnd)
+			if !ok1 || !ok2 || cfg.CheapestHours <= 0 {
+				log.Printf("automation %s: cheapest hours need CheapestHours, WindowStart and WindowEnd", cfg.Name)
+				continue
+			}
+		}
+
+		if st.cfg.OverrideMinutes == 0 {
+			st.cfg.OverrideMinutes = 60
+		}
+
+		s.states[cfg.Name] = st
+		s.list = append(s.list, st)
+		switch {
+		case cfg.Kind == AutomationKindCheapest:
+			// Driven by tick, there is no input
+		case cfg.Input != "":
+			s.byInput[cfg.Input] = append(s.byInput[cfg.Input], st)
+		default:
+			s.byTopic[cfg.Topic] = append(s.byTopic[cfg.Topic], st)
+		}
+	}
 }
 
 func (s *AutomationService) handleMessage(topic string, payload []byte) {
@@ -63,24 +180,219 @@ func (s *AutomationService) handleMessage(topic string, payload []byte) {
 		return
 	}
 	log.Printf("automation: %s = %v", topic, value)
-	for _, st := range s.byTopic[topic] {
-		s.evaluate(st, value)
+	s.handleValue(s.byTopic[topic], value)
+}
+
+func (s *AutomationService) handleValue(sts []*automationState, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, st := range sts {
+		s.evaluate(st, value, now)
+	}
+}
+
+func (s *AutomationService) evaluate(st *automationState, value float64, now time.Time) {
+	st.lastSample = now
+	st.lastValue = value
+	st.haveValue = true
+	if st.stale {
+		st.stale = false
+		log.Printf("automation %s: input is back, leaving fail-safe", st.cfg.Name)
+		s.notifyStale(st, false)
+	}
+
+	if st.controller != nil {
+		st.controller.update(st.cfg, value, now)
+		s.tickController(st, now)
+		return
+	}
+
+	st.triggered = s.condition(st, value)
+	s.apply(st, now)
+}
+
+// tick does the periodic work: ending manual overrides, switching duty-cycle
+// automations according to their position in the cycle and cheapest-hours
+// automations according to the prices.
+func (s *AutomationService) tick(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.list {
+		if !st.overrideUntil.IsZero() && !now.Before(st.overrideUntil) {
+			s.endOverride(st, now)
+		}
+		if st.controller != nil {
+			s.tickController(st, now)
+		}
+		if st.cfg.Kind == AutomationKindCheapest {
+			s.tickCheapest(st, now)
+		}
+	}
+}
+
+// checkStale moves automations whose input stayed silent for too long into
+// their fail-safe state.
+func (s *AutomationService) checkStale(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.states {
+		if st.stale || st.cfg.MaxSilenceSeconds <= 0 {
+			continue
+		}
+		staleAt := st.lastSample.Add(time.Duration(st.cfg.MaxSilenceSeconds) * time.Second)
+		if !now.After(staleAt) {
+			continue
+		}
+
+		st.stale = true
+		log.Printf("automation %s: no data since %s, fail-safe %q", st.cfg.Name, st.lastSample.Format("15:04:05"), st.cfg.FailSafe)
+		s.notifyStale(st, true)
+
+		switch st.cfg.FailSafe {
+		case AutomationFailSafeOn:
+			st.triggered = st.onState
+		case AutomationFailSafeOff:
+			st.triggered = !st.onState
+		default:
+			continue
+		}
+		s.apply(st, staleAt)
+	}
+}
+
+// notifyStale shows an alert and publishes the watchdog state of st to
+// screen-app/automation/<name>/stale.
+func (s *AutomationService) notifyStale(st *automationState, stale bool) {
+	if s.simulate {
+		return
+	}
+
+	if stale {
+		go showAlert(fmt.Sprintf("automation %s\nsensor silent", st.cfg.Name), 20*time.Second)
 	}
+	go func() {
+		topic := fmt.Sprintf("screen-app/automation/%s/stale", st.cfg.Name)
+		if err := mqttService.Publish(topic, strconv.FormatBool(stale), true); err != nil {
+			log.Printf("automation %s: could not publish stale event: %v", st.cfg.Name, err)
+		}
+	}()
 }
 
-func (s *AutomationService) evaluate(st *automationState, value float64) {
-	cond := s.condition(st, value)
+// apply runs the actions for st.triggered as soon as the short-cycle limits
+// allow it. Blocked transitions are scheduled for when the limit expires and
+// re-checked then. Must be called with s.mu held.
+func (s *AutomationService) apply(st *automationState, now time.Time) {
+	if now.Before(st.overrideUntil) {
+		return
+	}
+	if st.haveApplied && st.applied == st.triggered {
+		s.cancelPending(st)
+		return
+	}
 
-	if !st.haveSample {
-		st.haveSample = true
-		st.triggered = cond
-		s.fire(st, cond)
+	at := s.allowedAt(st, now)
+	if now.Before(at) {
+		s.schedule(st, at, now)
 		return
 	}
 
-	if cond != st.triggered {
-		st.triggered = cond
-		s.fire(st, cond)
+	s.cancelPending(st)
+	if st.haveApplied {
+		st.toggles = append(st.toggles, now)
+	}
+	st.applied = st.triggered
+	st.haveApplied = true
+	st.lastSwitch = now
+	s.fire(st, st.triggered, now)
+}
+
+// allowedAt returns the earliest time st may switch to another state.
+func (s *AutomationService) allowedAt(st *automationState, now time.Time) time.Time {
+	at := s.started.Add(time.Duration(st.cfg.StartupGraceSeconds) * time.Second)
+
+	if st.haveApplied {
+		minDuration := st.cfg.MinOffSeconds
+		if st.applied == st.onState {
+			minDuration = st.cfg.MinOnSeconds
+		}
+		if t := st.lastSwitch.Add(time.Duration(minDuration) * time.Second); t.After(at) {
+			at = t
+		}
+	}
+
+	if st.cfg.MaxTogglesPerHour > 0 {
+		// Drop toggles older than an hour
+		i := 0
+		for i < len(st.toggles) && now.Sub(st.toggles[i]) >= time.Hour {
+			i++
+		}
+		st.toggles = st.toggles[i:]
+
+		if len(st.toggles) >= st.cfg.MaxTogglesPerHour {
+			t := st.toggles[len(st.toggles)-st.cfg.MaxTogglesPerHour].Add(time.Hour)
+			if t.After(at) {
+				at = t
+			}
+		}
+	}
+
+	return at
+}
+
+func (s *AutomationService) schedule(st *automationState, at, now time.Time) {
+	if st.pendingAt.Equal(at) {
+		return
+	}
+	s.cancelPending(st)
+
+	log.Printf("automation %s: deferring switch to %v until %s", st.cfg.Name, st.triggered, at.Format("15:04:05"))
+	st.pendingAt = at
+	if s.simulate {
+		return
+	}
+	st.pending = time.AfterFunc(at.Sub(now), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		st.pending = nil
+		st.pendingAt = time.Time{}
+		s.apply(st, time.Now())
+	})
+}
+
+func (s *AutomationService) cancelPending(st *automationState) {
+	if st.pending != nil {
+		st.pending.Stop()
+		st.pending = nil
+	}
+	st.pendingAt = time.Time{}
+}
+
+// runPending applies all deferred switches due up to until in order. Only
+// used in simulation, the live service uses timers.
+func (s *AutomationService) runPending(until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		var next *automationState
+		for _, st := range s.states {
+			if st.pendingAt.IsZero() || st.pendingAt.After(until) {
+				continue
+			}
+			if next == nil || st.pendingAt.Before(next.pendingAt) {
+				next = st
+			}
+		}
+		if next == nil {
+			return
+		}
+
+		at := next.pendingAt
+		next.pendingAt = time.Time{}
+		s.apply(next, at)
 	}
 }
 
@@ -101,15 +413,100 @@ func (s *AutomationService) condition(st *automationState, value float64) bool {
 	return false
 }
 
-func (s *AutomationService) fire(st *automationState, cond bool) {
-	want := st.cfg.OnTrigger
-	if !cond {
-		want = !st.cfg.OnTrigger
+// fire runs the action list of the edge. Must be called with s.mu held.
+func (s *AutomationService) fire(st *automationState, cond bool, now time.Time) {
+	actions := st.onRelease
+	if cond {
+		actions = st.onTrigger
 	}
-	log.Printf("automation %s: condition=%v -> setting %s (%s) to %v", st.cfg.Name, cond, st.device.Name, st.device.UUID, want)
-	go func() {
-		if err := st.device.SetPlugState(want); err != nil {
-			log.Printf("automation %s: SetPlugState(%v) failed: %v", st.cfg.Name, want, err)
+	s.run(st, cond, actions, now)
+}
+
+// run starts actions for the edge cond. Must be called with s.mu held.
+func (s *AutomationService) run(st *automationState, cond bool, actions []AutomationAction, now time.Time) {
+	st.generation++
+
+	if s.simulate {
+		s.events = append(s.events, automationEvent{
+			at:        now,
+			name:      st.cfg.Name,
+			triggered: cond,
+			on:        cond == st.onState,
+		})
+		return
+	}
+	if st.cfg.DryRun {
+		for _, action := range actions {
+			log.Printf("automation %s: dry run, condition=%v -> would run %s", st.cfg.Name, cond, action)
 		}
-	}()
+		return
+	}
+
+	log.Printf("automation %s: condition=%v -> running %d actions", st.cfg.Name, cond, len(actions))
+	go s.runActions(st, st.generation, actions)
+}
+
+// runActions executes actions in order, retrying each failing one with
+// exponential backoff. It gives up once a newer edge has fired.
+func (s *AutomationService) runActions(st *automationState, generation int, actions []AutomationAction) {
+	failed := false
+	for _, action := range actions {
+		var err error
+		backoff := time.Second
+		for attempt := 0; attempt <= st.cfg.Retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(backoff)
+				backoff = min(backoff*2, 30*time.Second)
+			}
+			if s.outdated(st, generation) {
+				return
+			}
+
+			err = action.Execute()
+			if err == nil {
+				break
+			}
+			log.Printf("automation %s: %s failed (attempt %d/%d): %v", st.cfg.Name, action, attempt+1, st.cfg.Retries+1, err)
+		}
+		if err == nil {
+			continue
+		}
+
+		failed = true
+		s.mu.Lock()
+		st.lastErr = err
+		st.lastErrAt = time.Now()
+		s.mu.Unlock()
+		showAlert(fmt.Sprintf("automation %s\n%s failed", st.cfg.Name, action.Type), 20*time.Second)
+	}
+
+	if !failed {
+		s.mu.Lock()
+		if st.generation == generation {
+			st.lastErr = nil
+		}
+		s.mu.Unlock()
+	}
+}
+
+// onEdge reports which condition value switches the device on, judged by the
+// plug actions of both edges. Defaults to the trigger edge.
+func onEdge(onTrigger, onRelease []AutomationAction) bool {
+	for _, a := range onTrigger {
+		if a.Type == AutomationActionPlug {
+			return a.State
+		}
+	}
+	for _, a := range onRelease {
+		if a.Type == AutomationActionPlug {
+			return !a.State
+		}
+	}
+	return true
+}
+
+func (s *AutomationService) outdated(st *automationState, generation int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return st.generation != generation
 }
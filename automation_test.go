@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAllowedAt(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	now := started.Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		cfg     AutomationConfig
+		applied bool // on
+		since   time.Duration
+		toggles []time.Duration // ago
+		want    time.Time
+	}{
+		{
+			name: "no limits",
+			want: now,
+		},
+		{
+			name: "startup grace",
+			cfg:  AutomationConfig{StartupGraceSeconds: 7200},
+			want: started.Add(2 * time.Hour),
+		},
+		{
+			name:    "min on",
+			cfg:     AutomationConfig{MinOnSeconds: 300, MinOffSeconds: 600},
+			applied: true,
+			since:   time.Minute,
+			want:    now.Add(4 * time.Minute),
+		},
+		{
+			name:  "min off",
+			cfg:   AutomationConfig{MinOnSeconds: 300, MinOffSeconds: 600},
+			since: time.Minute,
+			want:  now.Add(9 * time.Minute),
+		},
+		{
+			name:    "min on expired",
+			cfg:     AutomationConfig{MinOnSeconds: 300},
+			applied: true,
+			since:   10 * time.Minute,
+			want:    now.Add(-5 * time.Minute),
+		},
+		{
+			name:    "toggles per hour",
+			cfg:     AutomationConfig{MaxTogglesPerHour: 2},
+			since:   10 * time.Minute,
+			toggles: []time.Duration{40 * time.Minute, 10 * time.Minute},
+			want:    now.Add(20 * time.Minute),
+		},
+		{
+			name:    "old toggles dropped",
+			cfg:     AutomationConfig{MaxTogglesPerHour: 2},
+			since:   10 * time.Minute,
+			toggles: []time.Duration{90 * time.Minute, 10 * time.Minute},
+			want:    now.Add(-10 * time.Minute),
+		},
+	}
+	for _, tt := range tests {
+		s := &AutomationService{started: started}
+		st := &automationState{
+			cfg:         tt.cfg,
+			onState:     true,
+			applied:     tt.applied,
+			haveApplied: true,
+			lastSwitch:  now.Add(-tt.since),
+		}
+		for _, ago := range tt.toggles {
+			st.toggles = append(st.toggles, now.Add(-ago))
+		}
+		if got := s.allowedAt(st, now); !got.Equal(tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.name, got.Format(time.TimeOnly), tt.want.Format(time.TimeOnly))
+		}
+	}
+}
+
+type automationStep struct {
+	at    time.Duration
+	value float64
+}
+
+// automationSwitch is a switch at a time relative to the start.
+type automationSwitch struct {
+	at time.Duration
+	on bool
+}
+
+// automationRun drives an "above 10" automation without actions through
+// steps on a simulated clock. Deferred switches are applied at their due
+// time instead of waiting for the timer.
+type automationRun struct {
+	start    time.Time
+	s        *AutomationService
+	st       *automationState
+	switches []automationSwitch
+}
+
+func newAutomationRun(cfg AutomationConfig) *automationRun {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cfg.Name = "heater"
+	cfg.Operator = AutomationOpAbove
+	cfg.Threshold = 10
+	return &automationRun{
+		start: start,
+		s:     &AutomationService{started: start},
+		st:    &automationState{cfg: cfg, onState: true},
+	}
+}
+
+func (r *automationRun) record() {
+	if !r.st.haveApplied {
+		return
+	}
+	at := r.st.lastSwitch.Sub(r.start)
+	if n := len(r.switches); n > 0 && r.switches[n-1].at == at {
+		return
+	}
+	r.switches = append(r.switches, automationSwitch{at: at, on: r.st.applied})
+}
+
+// runPending applies deferred switches due up to until.
+func (r *automationRun) runPending(until time.Duration) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for r.st.pending != nil && !r.st.pendingAt.After(r.start.Add(until)) {
+		r.st.pending.Stop()
+		r.st.pending = nil
+		r.s.apply(r.st, r.st.pendingAt)
+		r.record()
+	}
+}
+
+func (r *automationRun) feed(step automationStep) {
+	r.runPending(step.at)
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.evaluate(r.st, step.value, r.start.Add(step.at))
+	r.record()
+}
+
+func (r *automationRun) stop() {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.cancelPending(r.st)
+}
+
+func TestShortCycleDeferral(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   AutomationConfig
+		steps []automationStep
+		want  []automationSwitch
+	}{
+		{
+			name:  "startup grace",
+			cfg:   AutomationConfig{StartupGraceSeconds: 60},
+			steps: []automationStep{{0, 20}},
+			want:  []automationSwitch{{at: time.Minute, on: true}},
+		},
+		{
+			name: "newer value during startup grace wins",
+			cfg:  AutomationConfig{StartupGraceSeconds: 60},
+			steps: []automationStep{
+				{0, 20},
+				{30 * time.Second, 0},
+			},
+			want: []automationSwitch{{at: time.Minute}},
+		},
+		{
+			name:  "min on defers off",
+			cfg:   AutomationConfig{MinOnSeconds: 120},
+			steps: []automationStep{{0, 20}, {30 * time.Second, 0}},
+			want:  []automationSwitch{{at: 0, on: true}, {at: 2 * time.Minute}},
+		},
+		{
+			name: "deferred switch cancelled when value returns",
+			cfg:  AutomationConfig{MinOnSeconds: 120},
+			steps: []automationStep{
+				{0, 20},
+				{30 * time.Second, 0},
+				{time.Minute, 20},
+			},
+			want: []automationSwitch{{at: 0, on: true}},
+		},
+		{
+			name: "min off defers on",
+			cfg:  AutomationConfig{MinOffSeconds: 120},
+			steps: []automationStep{
+				{0, 20},
+				{30 * time.Second, 0},
+				{time.Minute, 20},
+			},
+			want: []automationSwitch{
+				{at: 0, on: true},
+				{at: 30 * time.Second},
+				{at: 150 * time.Second, on: true},
+			},
+		},
+		{
+			name: "toggles per hour",
+			cfg:  AutomationConfig{MaxTogglesPerHour: 2},
+			steps: []automationStep{
+				{0, 20},
+				{time.Minute, 0},
+				{2 * time.Minute, 20},
+				{3 * time.Minute, 0},
+			},
+			want: []automationSwitch{
+				{at: 0, on: true},
+				{at: time.Minute},
+				{at: 2 * time.Minute, on: true},
+				{at: 61 * time.Minute},
+			},
+		},
+	}
+	for _, tt := range tests {
+		r := newAutomationRun(tt.cfg)
+		for _, step := range tt.steps {
+			r.feed(step)
+		}
+		r.runPending(2 * time.Hour)
+		r.stop()
+
+		got := r.switches
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d switches, want %d: %+v", tt.name, len(got), len(tt.want), got)
+			continue
+		}
+		for i, want := range tt.want {
+			if got[i] != want {
+				t.Errorf("%s: switch %d: got %v at %s, want %v at %s", tt.name, i, got[i].on, got[i].at, want.on, want.at)
+			}
+		}
+	}
+}
+
+func TestDeferredSwitchCancelled(t *testing.T) {
+	r := newAutomationRun(AutomationConfig{MinOnSeconds: 120})
+	defer r.stop()
+
+	r.feed(automationStep{0, 20})
+	r.feed(automationStep{30 * time.Second, 0})
+	if r.st.pending == nil || !r.st.pendingAt.Equal(r.start.Add(2*time.Minute)) {
+		t.Fatalf("switch off not deferred to the end of min on, pending at %s", r.st.pendingAt)
+	}
+	r.feed(automationStep{time.Minute, 20})
+	if r.st.pending != nil {
+		t.Errorf("deferred switch still pending after the value returned")
+	}
+}
+
+func TestNewerEdgeOutdatesActions(t *testing.T) {
+	r := newAutomationRun(AutomationConfig{})
+	defer r.stop()
+
+	r.feed(automationStep{0, 20})
+	first := r.st.generation
+	if r.s.outdated(r.st, first) {
+		t.Fatalf("actions of the current edge outdated")
+	}
+	r.feed(automationStep{time.Minute, 0})
+	if !r.s.outdated(r.st, first) {
+		t.Errorf("retries of the previous edge not stopped by a newer edge")
+	}
+	if r.s.outdated(r.st, r.st.generation) {
+		t.Errorf("actions of the newer edge outdated")
+	}
+}
+
+func TestSwitchDeviceOverridesAutomation(t *testing.T) {
+	heater := &fakeMeter{EnergyDeviceBase: EnergyDeviceBase{Name: "heater"}}
+	fan := &fakeMeter{EnergyDeviceBase: EnergyDeviceBase{Name: "fan"}}
+
+	s := &AutomationService{}
+	s.init([]AutomationConfig{{
+		Name:      "heating",
+		Input:     "test:temperature",
+		Operator:  AutomationOpBelow,
+		Threshold: 18,
+		OnTriggerActions: []AutomationAction{
+			{Type: AutomationActionPlug, DeviceUUID: "heater", State: true},
+			{Type: AutomationActionPlug, DeviceUUID: "fan", State: true},
+			{Type: AutomationActionWebhook, URL: "http://127.0.0.1:1/"},
+		},
+		OnReleaseActions: []AutomationAction{
+			{Type: AutomationActionPlug, DeviceUUID: "heater", State: false},
+			{Type: AutomationActionPlug, DeviceUUID: "fan", State: false},
+		},
+	}}, time.Now().Add(-time.Hour))
+	defer func(prev *AutomationService) { automationService = prev }(automationService)
+	automationService = s
+
+	// Switched synchronously, without the other actions of the edge
+	if err := switchDevice(heater, true, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !heater.on || fan.switches != 0 {
+		t.Errorf("got heater %v, fan switched %d times", heater.on, fan.switches)
+	}
+	st := s.states["heating"]
+	if !st.applied || st.overrideUntil.IsZero() || !st.overrideOn {
+		t.Errorf("automation does not know about the switch: %+v", st)
+	}
+
+	heater.err = errors.New("relay stuck")
+	if err := switchDevice(heater, false, time.Minute); !errors.Is(err, heater.err) {
+		t.Errorf("got %v, want the relay error", err)
+	}
+	if st.lastErr == nil {
+		t.Errorf("switch failure not recorded on the automation")
+	}
+}
+
+func TestOverrideRunsPlugActions(t *testing.T) {
+	var webhooks atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhooks.Add(1)
+	}))
+	defer hook.Close()
+
+	heater := &fakeMeter{EnergyDeviceBase: EnergyDeviceBase{Name: "heater"}, switched: make(chan bool, 1)}
+	fan := &fakeMeter{EnergyDeviceBase: EnergyDeviceBase{Name: "fan"}, switched: make(chan bool, 1)}
+	defer func(prev []EnergyDevice) { energyDeviceList = prev }(energyDevices())
+	energyDeviceList = []EnergyDevice{heater, fan}
+
+	s := &AutomationService{}
+	s.init([]AutomationConfig{{
+		Name:      "heating",
+		Input:     "test:temperature",
+		Operator:  AutomationOpBelow,
+		Threshold: 18,
+		// The webhook runs first, so it would be done before the plugs
+		OnTriggerActions: []AutomationAction{
+			{Type: AutomationActionWebhook, URL: hook.URL},
+			{Type: AutomationActionPlug, DeviceUUID: "heater", State: true},
+			{Type: AutomationActionPlug, DeviceUUID: "fan", State: true},
+		},
+	}}, time.Now().Add(-time.Hour))
+
+	if err := s.Override("heating", true, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*fakeMeter{heater, fan} {
+		select {
+		case on := <-m.switched:
+			if !on {
+				t.Errorf("%s switched off", m.Name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not switched", m.Name)
+		}
+	}
+	if n := webhooks.Load(); n != 0 {
+		t.Errorf("override ran the webhook %d times", n)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/text"
+	"github.com/hajimehoshi/ebiten/v2/vector"
+)
+
+// AutomationUi lists all automations with their state. The on/off buttons of
+// a row override the device, repeated taps extend the override.
+type AutomationUi struct {
+	screen *ebiten.Image
+}
+
+var automationButtons = []string{"on", "off", "auto"}
+
+const (
+	automationRowHeight   = 72 + 48 + 30
+	automationButtonWidth = 110
+)
+
+func (ui *AutomationUi) Init() {
+	width, height := ui.Bounds()
+	ui.screen = ebiten.NewImage(width, height)
+}
+
+func (ui *AutomationUi) Bounds() (width, height int) {
+	return config.Width, max(len(config.Automations), 1) * automationRowHeight
+}
+
+func (ui *AutomationUi) Draw() *ebiten.Image {
+	ui.screen.Fill(bgColor)
+
+	if automationService == nil {
+		return ui.screen
+	}
+
+	now := time.Now()
+	for i, a := range automationService.status() {
+		y := i * automationRowHeight
+
+		c := textColor
+		if a.Stale || a.LastError != "" {
+			c = color.RGBA{255, 0, 0, 255}
+		}
+		text.Draw(ui.screen, strings.ToLower(a.Name), defaultFont, 0, y+fontHeight, c)
+
+		value := "-"
+		if a.HaveValue {
+			value = fmt.Sprintf("%.2f", a.Value)
+		}
+		lastSwitch := "never"
+		if !a.LastSwitch.IsZero() {
+			lastSwitch = a.LastSwitch.Format("15:04")
+		}
+		state := onOff(a.On)
+		if !a.OverrideUntil.IsZero() {
+			state = fmt.Sprintf("%s manual %s", onOff(a.OverrideOn), a.OverrideUntil.Sub(now).Round(time.Minute))
+		}
+		text.Draw(
+			ui.screen,
+			fmt.Sprintf("%s  %s  %s  since %s  %s", value, triggeredString(a.Triggered), state, lastSwitch, strings.Join(a.Devices, ", ")),
+			tinyFont,
+			0,
+			y+fontHeight+48,
+			c,
+		)
+
+		for j, label := range automationButtons {
+			x, by, w, h := ui.buttonRect(i, j)
+			active := (label == "auto" && a.OverrideUntil.IsZero()) ||
+				(!a.OverrideUntil.IsZero() && label == onOff(a.OverrideOn))
+			if active {
+				vector.DrawFilledRect(ui.screen, float32(x), float32(by), float32(w), float32(h), textColor, false)
+				text.Draw(ui.screen, label, smallFont, x+15, by+h-15, bgColor)
+			} else {
+				vector.StrokeRect(ui.screen, float32(x), float32(by), float32(w), float32(h), 2, textColor, false)
+				text.Draw(ui.screen, label, smallFont, x+15, by+h-15, textColor)
+			}
+		}
+	}
+
+	return ui.screen
+}
+
+func (ui *AutomationUi) buttonRect(row, button int) (x, y, w, h int) {
+	right := config.Width - paddingX*2
+	x = right - (len(automationButtons)-button)*(automationButtonWidth+linePadding*2)
+	return x, row*automationRowHeight + linePadding, automationButtonWidth, fontHeight - linePadding
+}
+
+func (ui *AutomationUi) Tap(x, y int) {
+	if automationService == nil {
+		return
+	}
+
+	status := automationService.status()
+	row := y / automationRowHeight
+	if row < 0 || row >= len(status) {
+		return
+	}
+	a := status[row]
+
+	for j, label := range automationButtons {
+		bx, by, w, h := ui.buttonRect(row, j)
+		if x < bx || x >= bx+w || y < by || y >= by+h {
+			continue
+		}
+
+		if label == "auto" {
+			automationService.ClearOverride(a.Name)
+			return
+		}
+
+		// Tapping the active override again extends it
+		on := label == "on"
+		step := automationService.overrideStep(a.Name)
+		d := step
+		if !a.OverrideUntil.IsZero() && a.OverrideOn == on {
+			d = time.Until(a.OverrideUntil) + step
+		}
+		automationService.Override(a.Name, on, d)
+		return
+	}
+}
@@ -292,7 +292,9 @@ type busTime struct {
 }
 
 var loc *time.Location
-var busTimes = map[string][]busTime{}
+
+// busTimes maps stop names to the next departures
+var busTimes Observable[map[string][]busTime]
 
 func pollBusTimes() {
 	var err error
@@ -302,9 +304,11 @@ func pollBusTimes() {
 	}
 
 	for {
+		times := map[string][]busTime{}
 		for _, stop := range config.Bus.Stops {
-			busTimes[stop.Name] = GetBusTime(stop.Origin, stop.Destination)
+			times[stop.Name] = GetBusTime(stop.Origin, stop.Destination)
 		}
+		busTimes.Set(times)
 		time.Sleep(time.Second * 30)
 	}
 
@@ -369,9 +373,10 @@ func (ui *BusUi) Bounds() (width, height int) {
 func (ui *BusUi) Draw() *ebiten.Image {
 	ui.screen.Fill(bgColor)
 
+	allTimes := busTimes.Get()
 	for i, stop := range config.Bus.Stops {
 		text.Draw(ui.screen, stop.Name, defaultFont, fontWidth*2+fontWidth*7*i, fontHeight, textColor)
-		times := busTimes[stop.Name]
+		times := allTimes[stop.Name]
 		for j, entry := range times {
 			if j >= 3 {
 				continue
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// cheapestWindow returns the occurrence of the window from start to end
+// (minutes since midnight) that contains now, or the next one.
+func cheapestWindow(startMin, endMin int, now time.Time) (time.Time, time.Time) {
+	day := startOfDay(now)
+	from := day.Add(time.Duration(startMin) * time.Minute)
+	to := day.Add(time.Duration(endMin) * time.Minute)
+	if endMin <= startMin {
+		to = to.AddDate(0, 0, 1)
+	}
+
+	// Still inside the occurrence that started yesterday
+	if now.Before(from) && now.Before(to.AddDate(0, 0, -1)) {
+		return from.AddDate(0, 0, -1), to.AddDate(0, 0, -1)
+	}
+	if !now.Before(to) {
+		return from.AddDate(0, 0, 1), to.AddDate(0, 0, 1)
+	}
+	return from, to
+}
+
+// cheapestSlots returns the starts of the n cheapest hours in [from, to).
+// Hours without a known dynamic price use the static tariff.
+func cheapestSlots(from, to time.Time, n int) []time.Time {
+	var slots []PricePoint
+	for t := from; t.Before(to); t = t.Add(time.Hour) {
+		slots = append(slots, PricePoint{Start: t, PricePerKWh: config.Energy.Tariff.price(t)})
+	}
+	// Earlier hours win on equal prices
+	sort.SliceStable(slots, func(i, j int) bool {
+		return slots[i].PricePerKWh < slots[j].PricePerKWh
+	})
+
+	res := make([]time.Time, 0, n)
+	for i := 0; i < n && i < len(slots); i++ {
+		res = append(res, slots[i].Start)
+	}
+	return res
+}
+
+// tickCheapest triggers st during the cheapest hours of its window. The plan
+// is recalculated every tick so prices published later are picked up. Must
+// be called with s.mu held.
+func (s *AutomationService) tickCheapest(st *automationState, now time.Time) {
+	startMin, ok1 := parseClock(st.cfg.WindowStart)
+	endMin, ok2 := parseClock(st.cfg.WindowEnd)
+	if !ok1 || !ok2 {
+		return
+	}
+
+	from, to := cheapestWindow(startMin, endMin, now)
+	triggered := false
+	if !now.Before(from) {
+		for _, slot := range cheapestSlots(from, to, st.cfg.CheapestHours) {
+			if !now.Before(slot) && now.Before(slot.Add(time.Hour)) {
+				triggered = true
+				break
+			}
+		}
+	}
+
+	st.lastSample = now
+	st.lastValue = config.Energy.Tariff.price(now)
+	st.haveValue = true
+	st.triggered = triggered
+	s.apply(st, now)
+}
@@ -27,14 +27,86 @@ type Config struct {
 		LineNumber string
 		Stops      []BusStopConfig
 	}
+	Storage struct {
+		// Directory of the history store, defaults to "data"
+		Path string
+	}
+	Http struct {
+		// e.g. ":8080", the server is disabled if empty
+		Listen string
+	}
 	Default_Font_Size int
 	Layout            []LayoutElement
 	Energy            struct {
 		MaxHistoryHours int
 		Profiles        map[string]string
-		Devices         []RefossEnergyDeviceConfig
+		// Refoss and Meross devices
+		Devices []RefossEnergyDeviceConfig
+		Shelly  []ShellyEnergyDeviceConfig
+		Tasmota []TasmotaEnergyDeviceConfig
+		// Meters that publish their power to an MQTT topic
+		Mqtt    []MqttEnergyDeviceConfig
+		Virtual []VirtualEnergyDeviceConfig
+		Tariff  TariffConfig
+		// Washing machines, dryers etc. whose cycles are detected
+		Appliances   []ApplianceConfig
+		Alerts       []PowerAlertConfig
+		LoadShedding LoadSheddingConfig
 	}
 	Automations []AutomationConfig
+	Export      struct {
+		Influx InfluxExportConfig
+	}
+}
+
+type InfluxExportConfig struct {
+	// Write endpoint, e.g.
+	// http://influx:8086/api/v2/write?org=home&bucket=screen. Disabled if
+	// empty.
+	URL string
+	// Sent as "Authorization: Token <Token>" if set
+	Token string
+	// Defaults to 10
+	IntervalSeconds int
+}
+
+type TariffConfig struct {
+	// Defaults to "€"
+	Currency string
+	// Default price, 0.35 if not set
+	PricePerKWh     float64
+	BaseFeePerMonth float64
+	// Time-of-use prices, the first matching window wins
+	Windows []TariffWindow
+	// Hourly prices of a dynamic tariff, used instead of the above while
+	// known
+	Dynamic DynamicPriceConfig
+}
+
+type DynamicPriceConfig struct {
+	// JSON feed shaped like https://api.awattar.de/v1/marketdata
+	URL string
+	// Local file in the same format, read instead of URL if set
+	File string
+	// Price per kWh = market price * Factor + Surcharge. Factor defaults to
+	// 1, e.g. 1.19 to add VAT.
+	Factor    float64
+	Surcharge float64
+	// Defaults to 60
+	RefreshMinutes int
+}
+
+type TariffWindow struct {
+	TimeWindow
+	PricePerKWh float64
+}
+
+type TimeWindow struct {
+	// "22:00", windows may wrap around midnight
+	Start string
+	End   string
+	// Weekdays like "mon", all days if empty
+	Days []string
 }
 
 type BusStopConfig struct {
@@ -51,31 +123,260 @@ const (
 )
 
 type AutomationConfig struct {
-	Name       string
-	Topic      string
+	Name string
+	// Kind selects threshold switching (default), a time-proportioning
+	// duty-cycle controller or the cheapest hours of a dynamic tariff
+	Kind  AutomationKind
+	Topic string
+	// Input reads a value calculated by the app instead of an MQTT topic,
+	// e.g. "vpd:tent", "energy:total" or "weather:humidity"
+	Input      string
 	Operator   AutomationOperator
 	Threshold  float64
 	Hysteresis float64
+	// DeviceUUID and OnTrigger are the legacy shorthand for a single plug
+	// action. They are only used when no action lists are configured.
 	DeviceUUID string
 	OnTrigger  bool
+	// Actions executed when the condition becomes true / false
+	OnTriggerActions []AutomationAction
+	OnReleaseActions []AutomationAction
+	// Retries per failing action, defaults to 3
+	Retries int
+	// Short-cycle protection. "On" is the edge whose plug action switches
+	// the device on (the trigger edge if there is no plug action). Blocked
+	// transitions are deferred until the limit allows them.
+	MinOnSeconds        int
+	MinOffSeconds       int
+	MaxTogglesPerHour   int
+	StartupGraceSeconds int
+	// DryRun logs the actions instead of running them
+	DryRun bool
+	// Watchdog: if the input is silent for longer than MaxSilenceSeconds the
+	// automation switches to FailSafe until data returns
+	MaxSilenceSeconds int
+	FailSafe          AutomationFailSafe
+	// Duty-cycle controller. Operator "below" switches on to raise the value
+	// to Setpoint (heater), "above" to lower it. The PI output is the share
+	// of each cycle the device is on.
+	Setpoint     float64
+	Kp           float64
+	Ki           float64
+	CycleSeconds int
+	// Cheapest hours: triggered during the CheapestHours cheapest hours
+	// between WindowStart and WindowEnd ("18:00" to "07:00"), e.g. to charge
+	// an e-bike over night
+	CheapestHours int
+	WindowStart   string
+	WindowEnd     string
+	// Duration of a manual override from the automations widget, and the
+	// step it is extended by on repeated taps. Defaults to 60.
+	OverrideMinutes int
+}
+
+type AutomationKind string
+
+const (
+	AutomationKindThreshold AutomationKind = "threshold"
+	AutomationKindDutyCycle AutomationKind = "dutycycle"
+	AutomationKindCheapest  AutomationKind = "cheapest"
+)
+
+type AutomationFailSafe string
+
+const (
+	AutomationFailSafeHold AutomationFailSafe = "hold"
+	AutomationFailSafeOn   AutomationFailSafe = "on"
+	AutomationFailSafeOff  AutomationFailSafe = "off"
+)
+
+type AutomationActionType string
+
+const (
+	AutomationActionPlug    AutomationActionType = "plug"
+	AutomationActionMqtt    AutomationActionType = "mqtt"
+	AutomationActionWebhook AutomationActionType = "webhook"
+	AutomationActionAlert   AutomationActionType = "alert"
+	AutomationActionSound   AutomationActionType = "sound"
+)
+
+type AutomationAction struct {
+	Type AutomationActionType
+	// plug, the UUID of a Refoss device or the ID of any other energy device
+	DeviceUUID string
+	State      bool
+	// mqtt
+	Topic   string
+	Payload string
+	Retain  bool
+	// webhook
+	URL    string
+	Method string
+	Body   string
+	// alert
+	Message  string
+	Duration int // seconds
+	// sound
+	File string
+}
+
+// EnergyDeviceBase holds the settings shared by all kinds of energy
+// devices.
+type EnergyDeviceBase struct {
+	Name      string
+	Aggregate []AggrTask
+	// Channels of multi channel energy monitors, each becomes its own
+	// series. Devices without channels read channel 0.
+	Channels []EnergyChannelConfig
+	// Channel switched by SetPlugState
+	SwitchChannel int
+	// Load shedding switches off the lowest priority first, devices
+	// without priority are never switched off
+	ShedPriority int
+	// Producers like balcony PV are charted and summed apart from the
+	// consumers. Their readings may be negative.
+	Producer bool
+	// Defaults to 500 and 5000. Offline devices are polled less often, up
+	// to once a minute.
+	PollIntervalMillis int
+	TimeoutMillis      int
 }
 
 type RefossEnergyDeviceConfig struct {
-	Name    string
+	EnergyDeviceBase
 	Address string
 	UUID    string
 	Profile string
+	// Talk to the device over the MQTT broker it is configured for instead
+	// of polling over HTTP. Switches are pushed. Address is used while the
+	// device does not answer over MQTT.
+	Mqtt bool
+}
+
+// ShellyEnergyDeviceConfig is a Shelly Gen2+ device using the JSON-RPC API.
+type ShellyEnergyDeviceConfig struct {
+	EnergyDeviceBase
+	// Used in aggregates and plug actions, defaults to Name
+	ID string
+	// e.g. http://192.168.1.30
+	Address string
+	// RPC component holding the power reading: "Switch" (default), "PM1"
+	// or "EM1". Channels are the component ids.
+	Component string
+}
+
+// TasmotaEnergyDeviceConfig reads Tasmota either over HTTP or, if Topic is
+// set, from its MQTT telemetry. Channels are the relay numbers starting
+// at 0.
+type TasmotaEnergyDeviceConfig struct {
+	EnergyDeviceBase
+	// Used in aggregates and plug actions, defaults to Name
+	ID       string
+	Address  string
+	Username string
+	Password string
+	// Tasmota device topic, e.g. "tasmota_5A1B2C"
+	Topic string
+}
+
+// MqttEnergyDeviceConfig is a single channel meter publishing its power in
+// watts, either as plain number or as JSON.
+type MqttEnergyDeviceConfig struct {
+	EnergyDeviceBase
+	// Used in aggregates and plug actions, defaults to Name
+	ID         string
+	PowerTopic string
+	// Field of a JSON payload holding the power, dots for nested objects,
+	// e.g. "ENERGY.Power". Plain number payloads if empty.
+	PowerField string
+	// Optional relay, payloads default to "ON" and "OFF"
+	SwitchTopic string
+	OnPayload   string
+	OffPayload  string
+}
+
+// VirtualEnergyDeviceConfig is computed from other devices, e.g.
+// "house - (fridge + pc)", "max(0, solar - house)" or "pv * 0.97". It is not
+// counted in the total.
+type VirtualEnergyDeviceConfig struct {
+	Name string
+	// Defaults to Name
+	ID string
+	// Operators + - * /, parentheses and min, max and abs. Names are device
+	// IDs or names, quote names with spaces like 'living room'.
+	Expression string
+	Producer   bool
+}
+
+// ApplianceConfig detects the cycles of an appliance from the power of an
+// energy device. A cycle starts when the power reaches StartWatts and ends
+// once it stayed below IdleWatts for IdleSeconds.
+type ApplianceConfig struct {
+	Name string
+	// Energy device ID or name, "<id>#<channel>" for channels
+	Device     string
+	StartWatts float64
+	IdleWatts  float64
+	// Shorter cycles are ignored, e.g. the pump running once
+	MinDurationSeconds int
+	// Defaults to 180, washing machines pause while soaking
+	IdleSeconds int
+	// Shown when a cycle ended, defaults to "<name> done"
+	Message string
+}
+
+// PowerAlertConfig raises an alert once the power of a device stayed above
+// AboveWatts for Minutes. With Windows it only applies inside them, e.g. to
+// catch devices left on at night.
+type PowerAlertConfig struct {
+	Name string
+	// Energy device ID or name, the total of all devices if empty
+	Device     string
+	AboveWatts float64
+	Minutes    int
+	// The alert clears below AboveWatts - Hysteresis
+	Hysteresis float64
+	Windows    []TimeWindow
+	// Alert again while the condition lasts, never if 0
+	RepeatMinutes int
+	// Devices switched off when the alert fires
+	SwitchOff []string
+}
+
+// LoadSheddingConfig switches off devices by ShedPriority while the total
+// power is over budget and restores them once there is room again.
+type LoadSheddingConfig struct {
+	// Disabled if 0
+	BudgetWatts float64
+	// How long the total has to be over budget, defaults to 10
+	DelaySeconds int
+	// Devices are restored once the total plus the power they drew before
+	// stays below BudgetWatts - RestoreMarginWatts for RestoreSeconds
+	// (default 60)
+	RestoreMarginWatts float64
+	RestoreSeconds     int
+	// Minimum time a device stays off, defaults to 300
+	MinOffSeconds int
+}
+
+type EnergyChannelConfig struct {
+	Channel   int
+	Name      string
 	Aggregate []AggrTask
+	Producer  bool
 }
 
 type AggrOp string
+
 const (
 	AggrOpAdd = "add"
 	AggrOpSub = "sub"
 )
 
 type AggrTask struct {
-	Device string
+	// ID of the device, "<id>#<channel>" for a channel of a multi
+	// channel device
+	Device    string
 	Operation AggrOp
 }
 
@@ -96,6 +397,16 @@ const (
 	LayoutElementClock   = LayoutElementType("clock")
 	LayoutElementCrypto  = LayoutElementType("crypto")
 	LayoutElementEnergy  = LayoutElementType("energy")
+	// Duty-cycle controller status
+	LayoutElementControllers = LayoutElementType("controllers")
+	// Automation status with manual override
+	LayoutElementAutomations = LayoutElementType("automations")
+	// Energy cost today, yesterday and this month
+	LayoutElementCost = LayoutElementType("cost")
+	// Hourly prices of a dynamic tariff
+	LayoutElementPrices = LayoutElementType("prices")
+	// Switchable plugs, tap to toggle
+	LayoutElementPlugs = LayoutElementType("plugs")
 )
 
 func loadConfig() {
@@ -142,4 +453,19 @@ func loadConfig() {
 	if config.Energy.MaxHistoryHours == 0 {
 		config.Energy.MaxHistoryHours = 6
 	}
+	if config.Storage.Path == "" {
+		config.Storage.Path = "data"
+	}
+	if config.Energy.Tariff.Currency == "" {
+		config.Energy.Tariff.Currency = "€"
+	}
+	if config.Energy.Tariff.PricePerKWh == 0 {
+		config.Energy.Tariff.PricePerKWh = 0.35
+	}
+	if config.Energy.Tariff.Dynamic.Factor == 0 {
+		config.Energy.Tariff.Dynamic.Factor = 1
+	}
+	if config.Energy.Tariff.Dynamic.RefreshMinutes == 0 {
+		config.Energy.Tariff.Dynamic.RefreshMinutes = 60
+	}
 }
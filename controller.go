@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/text"
+)
+
+// dutyCycleController turns a PI output into on/off time within a fixed cycle
+// window (time-proportioning control).
+type dutyCycleController struct {
+	value      float64
+	err        float64
+	integral   float64
+	output     float64 // 0..1
+	haveValue  bool
+	lastUpdate time.Time
+
+	cycleStart time.Time
+	onDuration time.Duration
+}
+
+func (c *dutyCycleController) update(cfg AutomationConfig, value float64, now time.Time) {
+	e := cfg.Setpoint - value
+	if cfg.Operator == AutomationOpAbove {
+		e = -e
+	}
+
+	if c.haveValue {
+		dt := now.Sub(c.lastUpdate).Seconds()
+		integral := c.integral + e*dt
+		// Anti windup: stop integrating while saturated in the same direction
+		out := cfg.Kp*e + cfg.Ki*integral
+		if (out >= 0 && out <= 1) || (out > 1 && e < 0) || (out < 0 && e > 0) {
+			c.integral = integral
+		}
+	}
+
+	c.value = value
+	c.err = e
+	c.lastUpdate = now
+	c.haveValue = true
+	c.output = min(max(cfg.Kp*e+cfg.Ki*c.integral, 0), 1)
+}
+
+// tickController must be called with s.mu held.
+func (s *AutomationService) tickController(st *automationState, now time.Time) {
+	c := st.controller
+	// Stale inputs are handled by the watchdog
+	if !c.haveValue || st.stale {
+		return
+	}
+
+	cycle := time.Duration(st.cfg.CycleSeconds) * time.Second
+	if c.cycleStart.IsZero() || now.Sub(c.cycleStart) >= cycle {
+		c.cycleStart = now
+		c.onDuration = time.Duration(c.output * float64(cycle))
+
+		// Do not plan pulses shorter than the minimum on/off times. Only
+		// round up to a full cycle if there is a pulse at all, an output of
+		// 0 must stay off even if MinOffSeconds exceeds the cycle.
+		if c.onDuration < time.Duration(st.cfg.MinOnSeconds)*time.Second {
+			c.onDuration = 0
+		}
+		if c.onDuration > 0 && cycle-c.onDuration < time.Duration(st.cfg.MinOffSeconds)*time.Second {
+			c.onDuration = cycle
+		}
+	}
+
+	on := now.Sub(c.cycleStart) < c.onDuration
+	st.triggered = on == st.onState
+	s.apply(st, now)
+}
+
+type controllerStatus struct {
+	name     string
+	setpoint float64
+	value    float64
+	err      float64
+	output   float64
+	on       bool
+	stale    bool
+}
+
+func (s *AutomationService) controllerStatus() []controllerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res []controllerStatus
+	for _, st := range s.states {
+		if st.controller == nil {
+			continue
+		}
+		res = append(res, controllerStatus{
+			name:     st.cfg.Name,
+			setpoint: st.cfg.Setpoint,
+			value:    st.controller.value,
+			err:      st.controller.err,
+			output:   st.controller.output,
+			on:       st.haveApplied && st.applied == st.onState,
+			stale:    st.stale,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+
+	return res
+}
+
+type ControllerUi struct {
+	screen *ebiten.Image
+}
+
+func (ui *ControllerUi) Init() {
+	width, height := ui.Bounds()
+	ui.screen = ebiten.NewImage(width, height)
+}
+
+func (ui *ControllerUi) Bounds() (width, height int) {
+	n := 0
+	for _, cfg := range config.Automations {
+		if cfg.Kind == AutomationKindDutyCycle {
+			n++
+		}
+	}
+	return config.Width, max(n, 1)*(fontHeight+48+linePadding*4) + linePadding*4
+}
+
+func (ui *ControllerUi) Draw() *ebiten.Image {
+	ui.screen.Fill(bgColor)
+
+	if automationService == nil {
+		return ui.screen
+	}
+
+	y := 0
+	for _, c := range automationService.controllerStatus() {
+		y += fontHeight
+		text.Draw(ui.screen, strings.ToLower(c.name), defaultFont, 0, y, textColor)
+
+		y += 48 + linePadding
+		status := onOff(c.on)
+		if c.stale {
+			status = "stale"
+		}
+		text.Draw(
+			ui.screen,
+			fmt.Sprintf("%.1f / %.1f   err %+.2f   out %d%%   %s", c.value, c.setpoint, c.err, int(c.output*100), status),
+			smallFont,
+			0,
+			y,
+			textColor,
+		)
+		y += linePadding * 3
+	}
+
+	return ui.screen
+}
@@ -21,6 +21,11 @@ var pricesText string
 type CurrencyPair struct {
 	symbol1 string
 	symbol2 string
+	quote   Observable[CurrencyQuote]
+}
+
+// CurrencyQuote is the latest price and the klines seen so far.
+type CurrencyQuote struct {
 	price   float64
 	history []binance.WsKlineEvent
 }
@@ -41,8 +46,6 @@ func pollBinance() {
 		pair := &CurrencyPair{
 			symbol1: symbol,
 			symbol2: "USDT",
-			price:   0,
-			history: make([]binance.WsKlineEvent, 0),
 		}
 		pairs = append(pairs, pair)
 
@@ -50,15 +53,20 @@ func pollBinance() {
 	}
 }
 
-func sortedCurrencyPairs() []*CurrencyPair {
+type currencySnapshot struct {
+	pair  *CurrencyPair
+	quote CurrencyQuote
+}
+
+func sortedCurrencyPairs() []currencySnapshot {
 	// Sort cyrrencies by price
-	var sortedPairs []*CurrencyPair
+	var sortedPairs []currencySnapshot
 	for _, pair := range pairs {
-		sortedPairs = append(sortedPairs, pair)
+		sortedPairs = append(sortedPairs, currencySnapshot{pair: pair, quote: pair.quote.Get()})
 	}
 	for i := 0; i < len(sortedPairs); i++ {
 		for j := i + 1; j < len(sortedPairs); j++ {
-			if sortedPairs[i].price < sortedPairs[j].price {
+			if sortedPairs[i].quote.price < sortedPairs[j].quote.price {
 				sortedPairs[i], sortedPairs[j] = sortedPairs[j], sortedPairs[i]
 			}
 		}
@@ -70,12 +78,16 @@ func sortedCurrencyPairs() []*CurrencyPair {
 func watchCurrency(pair *CurrencyPair) {
 	for {
 		wsKlineHandler := func(event *binance.WsKlineEvent) {
-			var err error
-			pair.price, err = strconv.ParseFloat(event.Kline.Close, 64)
-			pair.history = append(pair.history, *event)
+			price, err := strconv.ParseFloat(event.Kline.Close, 64)
 			if err != nil {
 				fmt.Println(err)
 			}
+			pair.quote.Update(func(q CurrencyQuote) CurrencyQuote {
+				return CurrencyQuote{
+					price:   price,
+					history: append(q.history, *event),
+				}
+			})
 		}
 		doneC, _, err := binance.WsKlineServe(
 			fmt.Sprintf("%s%s", pair.symbol1, pair.symbol2),
@@ -94,12 +106,12 @@ func watchCurrency(pair *CurrencyPair) {
 	}
 }
 
-func calcDelta(pair *CurrencyPair, span time.Duration) float64 {
-	if len(pair.history) == 0 {
+func calcDelta(quote CurrencyQuote, span time.Duration) float64 {
+	if len(quote.history) == 0 {
 		return 0
 	}
 
-	for _, event := range pair.history {
+	for _, event := range quote.history {
 		if time.Now().Sub(time.Unix(event.Kline.EndTime/1000, 0)) < span {
 			s := event.Kline.Close
 			f, err := strconv.ParseFloat(s, 64)
@@ -107,17 +119,17 @@ func calcDelta(pair *CurrencyPair, span time.Duration) float64 {
 				log.Fatal(err)
 			}
 
-			return pair.price - f
+			return quote.price - f
 		}
 	}
 
 	// If no event in the last hour, return the delta between the last event and the current price
-	last := pair.history[len(pair.history)-1].Kline.Close
+	last := quote.history[len(quote.history)-1].Kline.Close
 	f, err := strconv.ParseFloat(last, 64)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return pair.price - f
+	return quote.price - f
 }
 
 func (ui *CryptoUi) Init() {
@@ -133,7 +145,8 @@ func (ui *CryptoUi) Draw() *ebiten.Image {
 	ui.screen.Fill(bgColor)
 
 	prices := sortedCurrencyPairs()
-	for i, currency := range prices {
+	for i, snapshot := range prices {
+		currency := snapshot.quote
 		c := textColor
 		delta := calcDelta(currency, time.Hour*24)
 		if delta > 0 {
@@ -150,7 +163,7 @@ func (ui *CryptoUi) Draw() *ebiten.Image {
 			value = fmt.Sprintf("%.2e", currency.price)
 		}
 
-		line := fmt.Sprintf("%-5s %-8s %.1f%%", strings.ToLower(currency.symbol1), value, math.Abs(delta/currency.price*100))
+		line := fmt.Sprintf("%-5s %-8s %.1f%%", strings.ToLower(snapshot.pair.symbol1), value, math.Abs(delta/currency.price*100))
 		text.Draw(ui.screen, line, defaultFont, 0, (fontHeight+linePadding)*(i+1), c)
 	}
 
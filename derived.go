@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DerivedValues distributes values calculated inside the app so automations
+// can use them like MQTT topics. Names used:
+//
+//	temp:<grow sensor>, rh:<grow sensor>, vpd:<grow sensor>
+//	weather:temperature, weather:humidity, vpd:outdoor
+//	energy:total, energy:<device name>
+//	energy:production, energy:net (consumption - production, negative
+//	while feeding in)
+//	appliance:<appliance name> (1 while running)
+//	alert:<power alert name> (1 while active)
+//	loadshed:count (devices switched off by load shedding)
+//	price:current (price per kWh, with a dynamic tariff)
+type DerivedValues struct {
+	mu       sync.Mutex
+	handlers map[string][]func(float64)
+	last     map[string]float64
+}
+
+func (d *DerivedValues) On(name string, handler func(float64)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.handlers == nil {
+		d.handlers = map[string][]func(float64){}
+	}
+	d.handlers[name] = append(d.handlers[name], handler)
+}
+
+func (d *DerivedValues) Publish(name string, value float64) {
+	d.mu.Lock()
+	if d.last == nil {
+		d.last = map[string]float64{}
+	}
+	d.last[name] = value
+	hs := d.handlers[name]
+	d.mu.Unlock()
+
+	for _, h := range hs {
+		h(value)
+	}
+}
+
+func (d *DerivedValues) Get(name string) (float64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.last[name]
+	return v, ok
+}
+
+// runGrowDerivedValues publishes and records temperature, humidity and VPD of
+// each grow sensor independently of whether a grow widget is on screen.
+func runGrowDerivedValues() {
+	mqttService.WaitReady()
+
+	for _, sensor := range config.Grow.Sensors {
+		name := sensor.Name
+		var mu sync.Mutex
+		var temp, rh float64
+		var haveTemp, haveRh bool
+
+		publish := func() {
+			if haveTemp && haveRh {
+				vpd := calculateVPD(temp, rh)
+				derivedValues.Publish("vpd:"+name, vpd)
+				recordSample("grow."+name+".vpd", time.Now(), vpd)
+			}
+		}
+
+		mqttService.On(sensor.Temp, func(client mqtt.Client, msg mqtt.Message) {
+			v, err := parseValue(msg)
+			if err != nil {
+				log.Println("Could not parse MQTT message", msg.Topic(), err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			temp, haveTemp = v, true
+			derivedValues.Publish("temp:"+name, v)
+			recordSample("grow."+name+".temp", time.Now(), v)
+			publish()
+		})
+		mqttService.On(sensor.Humid, func(client mqtt.Client, msg mqtt.Message) {
+			v, err := parseValue(msg)
+			if err != nil {
+				log.Println("Could not parse MQTT message", msg.Topic(), err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			rh, haveRh = v, true
+			derivedValues.Publish("rh:"+name, v)
+			recordSample("grow."+name+".rh", time.Now(), v)
+			publish()
+		})
+	}
+}
@@ -2,22 +2,16 @@ package main
 
 import (
 	"log"
-	"os"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/hajimehoshi/ebiten/v2/audio"
-	"github.com/hajimehoshi/ebiten/v2/audio/mp3"
 )
 
 type DoorService struct {
-	lastRing     time.Time
-	audioContext *audio.Context
+	lastRing time.Time
 }
 
 func (s *DoorService) Run() {
-	s.audioContext = audio.NewContext(44100)
-
 	mqttService.WaitReady()
 
 	mqttService.Client.Subscribe("door/ring", 0, func(client mqtt.Client, msg mqtt.Message) {
@@ -27,46 +21,18 @@ func (s *DoorService) Run() {
 		defer func() {
 			s.lastRing = time.Now()
 		}()
-		if game == nil || time.Since(s.lastRing) < 21*time.Second {
+		if time.Since(s.lastRing) < 21*time.Second {
 			return
 		}
 
-		// Create new door alert modal
-		m := &ModalUi{
-			stackLayout: []UiElement{
-				&AlertUi{
-					msg: "  faggot on the\n     doooooor",
-				},
-			},
-		}
-		m.Init()
-		game.currentModal = m
-
-		// Remove door alert modal after 20s
-		go func() {
-			time.Sleep(time.Second * 20)
-			game.currentModal = nil
-		}()
+		// Show door alert modal for 20s
+		showAlert("  faggot on the\n     doooooor", time.Second*20)
 	})
 }
 
 func (s *DoorService) playAlarm() {
 	// Play door alarm sound mp3
-	soundFileReader, err := os.Open("./assets/alaram.mp3")
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	stream, err := mp3.DecodeWithSampleRate(44100, soundFileReader)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	player, err := s.audioContext.NewPlayer(stream)
-	if err != nil {
+	if err := playSound("./assets/alaram.mp3"); err != nil {
 		log.Println(err)
-		return
 	}
-	player.SetVolume(1)
-	player.Play()
 }
@@ -1,499 +1,525 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
-	"encoding/json"
 	"fmt"
-	"image"
-	"image/draw"
-	"image/png"
-	"io"
 	"log"
-	"math/rand"
-	"net/http"
+	"math"
+	"strings"
+	"sync"
 	"time"
 
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/text"
-	"github.com/wcharczuk/go-chart/v2"
-	"github.com/wcharczuk/go-chart/v2/drawing"
+	"github.com/hajimehoshi/ebiten/v2/vector"
 )
 
-type RefossDeviceConfigHeader struct {
-	MessageID      string `json:"messageId"`
-	Method         string `json:"method"`
-	From           string `json:"from"`
-	PayloadVersion int    `json:"payloadVersion"`
-	Namespace      string `json:"namespace"`
-	UUID           string `json:"uuid"`
-	Sign           string `json:"sign"`
-	TriggerSrc     string `json:"triggerSrc"`
-	Timestamp      int    `json:"timestamp"`
+// energyRanges are the selectable chart ranges. Ranges longer than
+// MaxHistoryHours are read from the history store.
+var energyRanges = []struct {
+	label string
+	span  time.Duration
+}{
+	{"15m", 15 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
 }
 
-type RefossDeviceConfigRequest struct {
-	Header  RefossDeviceConfigHeader `json:"header"`
-	Payload struct {
-		Electricity RefossDeviceConfigRequestElectricity `json:"electricity"`
-	} `json:"payload"`
-}
-
-type RefossDeviceConfigRequestElectricity struct {
-	Channel int `json:"channel"`
-}
-
-type RefossToggleRequest struct {
-	Header  RefossDeviceConfigHeader `json:"header"`
-	Payload RefossTogglePayload      `json:"payload"`
-}
-
-type RefossTogglePayload struct {
-	Togglex RefossToggleX `json:"togglex"`
-}
-
-type RefossToggleX struct {
-	Channel int `json:"channel"`
-	Onoff   int `json:"onoff"`
-}
-
-type RefossDeviceConfigResponse struct {
-	Header  RefossDeviceConfigHeader `json:"header"`
-	Payload struct {
-		Electricity struct {
-			Channel int `json:"channel"`
-			Current int `json:"current"`
-			Voltage int `json:"voltage"`
-			Power   int `json:"power"`
-			Config  struct {
-				VoltageRatio          int `json:"voltageRatio"`
-				ElectricityRatio      int `json:"electricityRatio"`
-				MaxElectricityCurrent int `json:"maxElectricityCurrent"`
-				PowerRatio            int `json:"powerRatio"`
-			} `json:"config"`
-		} `json:"electricity"`
-	} `json:"payload"`
-}
+const (
+	energyButtonTop    = 120
+	energyButtonWidth  = 130
+	energyButtonHeight = 70
+	energyChartTop     = 210
+	energySolarTop     = 950
+	// The history store is read at most this often
+	energyPersistedRefresh = time.Minute
+)
 
+// EnergyUi charts the power of all devices. The buttons select the range,
+// tapping the color of a legend entry hides the series and tapping its name
+// opens the detail view of the device. The same works with the commands
+// "range 24h", "toggle <device>", "detail <device>" and "back" on
+// screen-app/energy/view.
 type EnergyUi struct {
 	screen *ebiten.Image
 
 	deviceStates []*EnergySensorState
-	chartImage   *ebiten.Image
-	graph        *chart.Chart
-	renderBuf    *bytes.Buffer
-	rgbaBuf      *image.RGBA
+	// Series of chart and solarChart in order
+	consumers []*EnergySensorState
+	producers []*EnergySensorState
+	chart     *TimeChart
+	// Producers, nil without any
+	solarChart  *TimeChart
+	detailChart *TimeChart
+	solarDay    Observable[SolarDay]
+	detailStats Observable[energyDetailStats]
+
+	mu         sync.Mutex
+	rangeIndex int
+	hidden     map[*EnergySensorState]bool
+	detail     *EnergySensorState
+	// changed forces the next update after a view change
+	changed bool
+
+	// version is the sum of all history versions at the last update
+	version uint64
+	// Time and span of the last read from the history store, span 0 while
+	// the in-memory history is shown
+	persistedAt   time.Time
+	persistedSpan time.Duration
 }
 
-type EnergySensorState struct {
-	deviceConfig RefossEnergyDeviceConfig
-	timestamps   []time.Time
-	values       []float64
-	series       *chart.TimeSeries
+// energyDetailStats are calculated from today's minute averages.
+type energyDetailStats struct {
+	device   *EnergySensorState
+	todayKWh float64
+	peak     float64
+	peakAt   time.Time
 }
 
 func (ui *EnergyUi) Init() {
 	width, height := ui.Bounds()
 	ui.screen = ebiten.NewImage(width, height)
-	ui.chartImage = ebiten.NewImage(width-50, 800)
-	ui.renderBuf = bytes.NewBuffer(make([]byte, 0, 1024*1024))
-	ui.rgbaBuf = image.NewRGBA(image.Rect(0, 0, width-50, 800))
-
-	for _, device := range config.Energy.Devices {
-		ui.deviceStates = append(ui.deviceStates, &EnergySensorState{
-			deviceConfig: device,
-			timestamps:   []time.Time{},
-			values:       []float64{},
-			series: &chart.TimeSeries{
-				Name: device.Name,
-				Style: chart.Style{
-					StrokeWidth: 1.4,
-				},
-			},
-		})
+	ui.deviceStates = energyService.devices
+	ui.hidden = map[*EnergySensorState]bool{}
+
+	// Start with the range closest to the in-memory history
+	ui.rangeIndex = len(energyRanges) - 1
+	for i, r := range energyRanges {
+		if r.span >= time.Duration(config.Energy.MaxHistoryHours)*time.Hour {
+			ui.rangeIndex = i
+			break
+		}
 	}
 
-	ui.initGraph()
-	go ui.pollDeviceStates()
+	if energyService.hasProducers() {
+		ui.chart = NewTimeChart(width-50, 600)
+		ui.solarChart = NewTimeChart(width-50, 400)
+	} else {
+		ui.chart = NewTimeChart(width-50, 800)
+	}
+	ui.detailChart = NewTimeChart(width-50, 500)
+	for _, device := range ui.deviceStates {
+		if ui.solarChart == nil || !device.producer {
+			ui.consumers = append(ui.consumers, device)
+		} else {
+			ui.producers = append(ui.producers, device)
+		}
+	}
+
+	// Update chart
+	go func() {
+		for {
+			ui.updateGraph()
+			time.Sleep(time.Millisecond * 500)
+		}
+	}()
+
+	if ui.solarChart != nil {
+		go func() {
+			for {
+				ui.solarDay.Set(energyService.solarDay(time.Now()))
+				time.Sleep(30 * time.Second)
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			ui.updateDetailStats()
+			time.Sleep(30 * time.Second)
+		}
+	}()
+
+	go func() {
+		mqttService.WaitReady()
+		mqttService.On("screen-app/energy/view", func(client mqtt.Client, msg mqtt.Message) {
+			if err := ui.command(string(msg.Payload())); err != nil {
+				log.Println("energy view:", err)
+			}
+		})
+	}()
 }
 
 func (ui *EnergyUi) Bounds() (width, height int) {
-	return config.Width, 1300
+	if energyService.hasProducers() {
+		return config.Width, 1870
+	}
+	return config.Width, 1370
 }
 
 func (ui *EnergyUi) Draw() *ebiten.Image {
 	ui.screen.Fill(bgColor)
 
-	// Draw the energy usage for each device
-	// for i, device := range config.Refoss_Energy_Devices {
-	// 	usage := energyUsage[device.Address]
-	// 	text.Draw(ui.screen, fmt.Sprintf("%s: %dW", strings.ToLower(device.Name), usage), defaultFont, 0, fontHeight+(linePadding+fontHeight)*i, textColor)
-	// }
+	ui.mu.Lock()
+	rangeIndex, detail := ui.rangeIndex, ui.detail
+	ui.mu.Unlock()
 
-	text.Draw(ui.screen, "power", defaultFont, 0, 100, textColor)
+	title := "power"
+	if detail != nil {
+		title = strings.ToLower(detail.name)
+	}
+	text.Draw(ui.screen, title, defaultFont, 0, 100, textColor)
+	if status := ui.healthStatus(); status != "" && detail == nil {
+		text.Draw(ui.screen, status, smallFont, 250, 90, textColor)
+	}
 
-	pos := ebiten.GeoM{}
-	pos.Translate(0, 140)
-	ui.screen.DrawImage(ui.chartImage, &ebiten.DrawImageOptions{
-		GeoM: pos,
-	})
+	for j, label := range ui.buttons(detail != nil) {
+		x, y, w, h := ui.buttonRect(j)
+		if j == rangeIndex {
+			vector.DrawFilledRect(ui.screen, float32(x), float32(y), float32(w), float32(h), textColor, false)
+			text.Draw(ui.screen, label, smallFont, x+15, y+h-15, bgColor)
+		} else {
+			vector.StrokeRect(ui.screen, float32(x), float32(y), float32(w), float32(h), 2, textColor, false)
+			text.Draw(ui.screen, label, smallFont, x+15, y+h-15, textColor)
+		}
+	}
 
-	usage := 0.0
-	for _, device := range ui.deviceStates {
-		if len(device.series.YValues) == 0 {
-			continue
+	y := 1170
+	if ui.solarChart != nil {
+		y = 1450
+	}
+	if detail != nil {
+		ui.drawDetail(detail)
+	} else {
+		pos := ebiten.GeoM{}
+		pos.Translate(0, energyChartTop)
+		ui.screen.DrawImage(ui.chart.Draw(), &ebiten.DrawImageOptions{
+			GeoM: pos,
+		})
+
+		if ui.solarChart != nil {
+			text.Draw(ui.screen, "solar", defaultFont, 0, energySolarTop-40, textColor)
+			pos := ebiten.GeoM{}
+			pos.Translate(0, energySolarTop)
+			ui.screen.DrawImage(ui.solarChart.Draw(), &ebiten.DrawImageOptions{
+				GeoM: pos,
+			})
 		}
-		usage += device.series.YValues[len(device.series.YValues)-1]
 	}
+
+	usage := energyService.total()
 	text.Draw(
 		ui.screen,
-		fmt.Sprintf("total consooomtion:\n\n   %dW %.2f€/h", int(usage), usage/1000*0.35),
+		fmt.Sprintf(
+			"total consooomtion:\n\n   %dW %.2f%s/h",
+			int(usage),
+			usage/1000*config.Energy.Tariff.price(time.Now()),
+			config.Energy.Tariff.Currency,
+		),
 		defaultFont,
 		0,
-		1100,
+		y,
 		textColor,
 	)
 
+	if ui.solarChart != nil {
+		day := ui.solarDay.Get()
+		text.Draw(
+			ui.screen,
+			fmt.Sprintf(
+				"solar %dW  net %+dW\ntoday %.2fkwh\nself %d%%  autarky %d%%",
+				int(energyService.production()),
+				int(energyService.net()),
+				day.ProducedKWh,
+				int(math.Round(day.SelfConsumption()*100)),
+				int(math.Round(day.Autarky()*100)),
+			),
+			smallFont,
+			0,
+			y+220,
+			textColor,
+		)
+	}
+
 	return ui.screen
 }
 
-func (ui *EnergyUi) pollDeviceStates() {
-	for _, device := range ui.deviceStates {
-		go func(s *EnergySensorState) {
-			for {
-				err := s.fetchState()
-				if err != nil {
-					log.Println("Error polling refoss device:", s.deviceConfig.Address, err)
-				}
-				time.Sleep(time.Millisecond*500)
-			}
-		}(device)
-	}
+// drawDetail shows the chart and the latest reading of a single device.
+func (ui *EnergyUi) drawDetail(d *EnergySensorState) {
+	pos := ebiten.GeoM{}
+	pos.Translate(0, energyChartTop)
+	ui.screen.DrawImage(ui.detailChart.Draw(), &ebiten.DrawImageOptions{
+		GeoM: pos,
+	})
 
-	// Update chart
-	go func() {
-		for {
-			time.Sleep(time.Millisecond*500)
-			ui.updateGraph()
+	y := energyChartTop + 500 + fontHeight + 20
+	watts, _ := d.latest()
+	text.Draw(ui.screen, fmt.Sprintf("%dW", int(watts)), defaultFont, 0, y, textColor)
+
+	var lines []string
+	if r := d.reading.Get(); r.Volts > 0 {
+		lines = append(lines, fmt.Sprintf("%.1fV  %.2fA  pf %.2f", r.Volts, r.Amps, r.Factor))
+	}
+	if stats := ui.detailStats.Get(); stats.device == d {
+		lines = append(lines, fmt.Sprintf("today %.2fkwh", stats.todayKWh))
+		if !stats.peakAt.IsZero() {
+			lines = append(lines, fmt.Sprintf("peak %dW at %s", int(stats.peak), stats.peakAt.Format("15:04")))
 		}
-	}()
+	}
+	text.Draw(ui.screen, strings.Join(lines, "\n"), smallFont, 0, y+70, textColor)
 }
 
-// generateRandomString creates a random string of specified length
-func generateRandomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
-	result := make([]byte, length)
-	for i := range result {
-		result[i] = charset[rand.Intn(len(charset))]
+// buttons returns the labels of the range buttons, followed by "back" in
+// the detail view.
+func (ui *EnergyUi) buttons(detail bool) []string {
+	labels := make([]string, 0, len(energyRanges)+1)
+	for _, r := range energyRanges {
+		labels = append(labels, r.label)
+	}
+	if detail {
+		labels = append(labels, "back")
 	}
-	return string(result)
+	return labels
 }
 
-// md5Hash generates an MD5 hash of the input string
-func md5Hash(input string) string {
-	hash := md5.Sum([]byte(input))
-	return fmt.Sprintf("%x", hash)
+func (ui *EnergyUi) buttonRect(button int) (x, y, w, h int) {
+	return button * (energyButtonWidth + linePadding*2), energyButtonTop, energyButtonWidth, energyButtonHeight
 }
 
-// generateMessageId replicates the g3() function from Java
-func generateMessageId() string {
-	// Initialize random seed
-	rand.Seed(time.Now().UnixNano())
+func (ui *EnergyUi) Tap(x, y int) {
+	ui.mu.Lock()
+	detail := ui.detail
+	ui.mu.Unlock()
 
-	// Generate random string of 16 chars (k(16))
-	randomStr := generateRandomString(16)
+	for j := range ui.buttons(detail != nil) {
+		bx, by, w, h := ui.buttonRect(j)
+		if x < bx || x >= bx+w || y < by || y >= by+h {
+			continue
+		}
+		if j < len(energyRanges) {
+			ui.setRange(j)
+		} else {
+			ui.showDetail(nil)
+		}
+		return
+	}
+	if detail != nil {
+		return
+	}
 
-	// Get current timestamp in seconds (m())
-	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	charts := []struct {
+		chart   *TimeChart
+		devices []*EnergySensorState
+		top     int
+	}{
+		{ui.chart, ui.consumers, energyChartTop},
+		{ui.solarChart, ui.producers, energySolarTop},
+	}
+	for _, c := range charts {
+		if c.chart == nil {
+			continue
+		}
+		if i, swatch := c.chart.LegendAt(x, y-c.top); i >= 0 {
+			if swatch {
+				ui.toggle(c.devices[i])
+			} else {
+				ui.showDetail(c.devices[i])
+			}
+			return
+		}
+	}
+}
 
-	// Combine and hash (g())
-	return md5Hash(randomStr + timestamp)
+// command handles "range <label>", "toggle <device>", "detail <device>"
+// and "back".
+func (ui *EnergyUi) command(cmd string) error {
+	verb, arg, _ := strings.Cut(strings.TrimSpace(cmd), " ")
+	arg = strings.TrimSpace(arg)
+
+	switch strings.ToLower(verb) {
+	case "range":
+		for i, r := range energyRanges {
+			if strings.EqualFold(r.label, arg) {
+				ui.setRange(i)
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown range %q", arg)
+	case "toggle", "detail":
+		d := energyService.deviceByName(arg)
+		if d == nil {
+			return fmt.Errorf("device %q not found", arg)
+		}
+		if strings.EqualFold(verb, "toggle") {
+			ui.toggle(d)
+		} else {
+			ui.showDetail(d)
+		}
+		return nil
+	case "back":
+		ui.showDetail(nil)
+		return nil
+	}
+	return fmt.Errorf("invalid command %q", cmd)
 }
 
-// generateSign replicates the h3() function from Java
-func generateSign(messageId, key, timestamp string) string {
-	// Concatenate the three parameters and hash
-	return md5Hash(messageId + key + timestamp)
+func (ui *EnergyUi) setRange(i int) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.rangeIndex = i
+	ui.changed = true
 }
 
-func (e *EnergySensorState) fetchState() error {
-	// Generate message ID based on the Java implementation
-	messageId := generateMessageId()
+func (ui *EnergyUi) toggle(d *EnergySensorState) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.hidden[d] = !ui.hidden[d]
+	ui.changed = true
+}
 
-	timestamp := time.Now().Unix()
+// showDetail opens the detail view of d, nil returns to all devices.
+func (ui *EnergyUi) showDetail(d *EnergySensorState) {
+	ui.mu.Lock()
+	ui.detail = d
+	ui.changed = true
+	ui.mu.Unlock()
 
-	// Get key for profile
-	key, ok := config.Energy.Profiles[e.deviceConfig.Profile]
-	if !ok {
-		return fmt.Errorf("meross profile %s not found", e.deviceConfig.Profile)
+	if d != nil {
+		go ui.updateDetailStats()
 	}
+}
 
-	// Generate sign based on the Java implementation
-	sign := generateSign(messageId, key, fmt.Sprintf("%d", timestamp))
-
-	url := fmt.Sprintf("%s/config", e.deviceConfig.Address)
-
-	reqData := RefossDeviceConfigRequest{
-		Header: RefossDeviceConfigHeader{
-			Method:         "GET",
-			From:           url,
-			MessageID:      messageId,
-			PayloadVersion: 1,
-			Namespace:      "Appliance.Control.Electricity",
-			UUID:           e.deviceConfig.UUID,
-			Sign:           sign,
-			TriggerSrc:     "GoClient",
-			Timestamp:      int(timestamp),
-		},
-		Payload: struct {
-			Electricity RefossDeviceConfigRequestElectricity "json:\"electricity\""
-		}{
-			Electricity: RefossDeviceConfigRequestElectricity{
-				Channel: 0,
-			},
-		},
-	}
-	reqDataJson, err := json.Marshal(reqData)
-	if err != nil {
-		return err
+// updateDetailStats calculates today's energy and peak of the device in
+// the detail view.
+func (ui *EnergyUi) updateDetailStats() {
+	ui.mu.Lock()
+	d := ui.detail
+	ui.mu.Unlock()
+	if d == nil {
+		return
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(reqDataJson))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Proxy-Connection", "keep-alive")
-	req.Header.Set("User-Agent", "intellect_socket/1.10.0 (iPhone; iOS 18.3.2; Scale/3.00)")
-	req.Header.Set("Accept-Language", "en-DE;q=1, de-DE;q=0.9")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	now := time.Now()
+	h := energyService.persistedHistory(startOfDay(now), now, time.Minute)[d]
+	stats := energyDetailStats{device: d}
+	for i, v := range h.aggregated {
+		if d.producer {
+			v = math.Abs(v)
+		}
+		stats.todayKWh += v / 60 / 1000
+		if v > stats.peak {
+			stats.peak = v
+			stats.peakAt = h.timestamps[i]
+		}
 	}
+	ui.detailStats.Set(stats)
+}
 
-	var resData RefossDeviceConfigResponse
-	err = json.Unmarshal(body, &resData)
-	if err != nil {
-		return err
+// healthStatus lists the devices which are not online, e.g.
+// "offline: fridge  degraded: pc".
+func (ui *EnergyUi) healthStatus() string {
+	var offline, degraded []string
+	for _, device := range ui.deviceStates {
+		switch device.healthState() {
+		case DeviceOffline:
+			offline = append(offline, device.name)
+		case DeviceDegraded:
+			degraded = append(degraded, device.name)
+		}
 	}
 
-	// log.Println(e.deviceConfig.Address)
-	// spew.Dump(resData.Payload.Electricity.Power/1000)
-
-	now := time.Now()
-	p := float64(resData.Payload.Electricity.Power) / 1000
-	e.values = append(e.values, p)
-	e.timestamps = append(e.timestamps, now)
-
-	// Get history length
-	diff := now.Sub(e.timestamps[0])
-	if diff > time.Hour*time.Duration(config.Energy.MaxHistoryHours) {
-		// Drop oldest value
-		e.values = e.values[1:]
-		e.timestamps = e.timestamps[1:]
+	var parts []string
+	if len(offline) > 0 {
+		parts = append(parts, "offline: "+strings.Join(offline, ", "))
 	}
-
-	return nil
+	if len(degraded) > 0 {
+		parts = append(parts, "degraded: "+strings.Join(degraded, ", "))
+	}
+	return strings.Join(parts, "  ")
 }
 
-func (d *RefossEnergyDeviceConfig) SetPlugState(on bool) error {
-	messageId := generateMessageId()
-	timestamp := time.Now().Unix()
-
-	key, ok := config.Energy.Profiles[d.Profile]
-	if !ok {
-		return fmt.Errorf("meross profile %s not found", d.Profile)
+// updateGraph hands the device histories of the selected range to the
+// charts, which only redraw if they changed. Series of devices which are not
+// online are greyed out.
+func (ui *EnergyUi) updateGraph() {
+	ui.mu.Lock()
+	span := energyRanges[ui.rangeIndex].span
+	detail := ui.detail
+	hidden := make(map[*EnergySensorState]bool, len(ui.hidden))
+	for d, h := range ui.hidden {
+		hidden[d] = h
 	}
+	changed := ui.changed
+	ui.changed = false
+	ui.mu.Unlock()
 
-	sign := generateSign(messageId, key, fmt.Sprintf("%d", timestamp))
-
-	url := fmt.Sprintf("%s/config", d.Address)
-
-	onoff := 0
-	if on {
-		onoff = 1
+	for i, device := range ui.consumers {
+		ui.chart.SetDimmed(i, device.healthState() != DeviceOnline)
+		ui.chart.SetHidden(i, hidden[device])
 	}
-
-	reqData := RefossToggleRequest{
-		Header: RefossDeviceConfigHeader{
-			Method:         "SET",
-			From:           url,
-			MessageID:      messageId,
-			PayloadVersion: 1,
-			Namespace:      "Appliance.Control.ToggleX",
-			UUID:           d.UUID,
-			Sign:           sign,
-			TriggerSrc:     "GoClient",
-			Timestamp:      int(timestamp),
-		},
-		Payload: RefossTogglePayload{
-			Togglex: RefossToggleX{
-				Channel: 0,
-				Onoff:   onoff,
-			},
-		},
+	for i, device := range ui.producers {
+		ui.solarChart.SetDimmed(i, device.healthState() != DeviceOnline)
+		ui.solarChart.SetHidden(i, hidden[device])
 	}
 
-	reqDataJson, err := json.Marshal(reqData)
-	if err != nil {
-		return err
+	now := time.Now()
+	history := ui.histories(span, now, changed)
+	if history == nil {
+		return
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(reqDataJson))
-	if err != nil {
-		return err
+	for i, device := range ui.consumers {
+		h := history(device)
+		ui.chart.SetSeries(i, device.name, h.timestamps, h.aggregated)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Proxy-Connection", "keep-alive")
-	req.Header.Set("User-Agent", "intellect_socket/1.10.0 (iPhone; iOS 18.3.2; Scale/3.00)")
-	req.Header.Set("Accept-Language", "en-DE;q=1, de-DE;q=0.9")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+	for i, device := range ui.producers {
+		h := history(device)
+		ui.solarChart.SetSeries(i, device.name, h.timestamps, chartProduction(h.aggregated))
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("plug %s set state failed: %d: %s", d.UUID, resp.StatusCode, string(body))
+	if detail != nil {
+		h := history(detail)
+		values := h.aggregated
+		if detail.producer {
+			values = chartProduction(values)
+		}
+		ui.detailChart.SetSeries(0, detail.name, h.timestamps, values)
 	}
 
-	return nil
-}
-
-func (ui *EnergyUi) initGraph() {
-	fill := drawing.Color{R: bgColor.R, G: bgColor.G, B: bgColor.B, A: bgColor.A}
-	font := drawing.Color{R: textColor.R, G: textColor.G, B: textColor.B, A: textColor.A}
-	width, _ := ui.Bounds()
-
-	ui.graph = &chart.Chart{
-		DPI: 100,
-		Background: chart.Style{
-			FillColor: chart.ColorTransparent,
-		},
-		Canvas: chart.Style{
-			FillColor: fill,
-		},
-		XAxis: chart.XAxis{
-			ValueFormatter: chart.TimeValueFormatterWithFormat("15:04"),
-		},
-		YAxis: chart.YAxis{
-			Style: chart.Style{
-				FontColor: font,
-			},
-			Range: &chart.ContinuousRange{
-				Max: 800,
-			},
-		},
-		Series: make([]chart.Series, len(ui.deviceStates)),
-		Width:  width - 50,
-		Height: 800,
-	}
-
-	// Add all series to the chart
-	for i, device := range ui.deviceStates {
-		ui.graph.Series[i] = device.series
-	}
-
-	ui.graph.Elements = append(ui.graph.Elements, chart.LegendLeft(ui.graph, chart.Style{
-		FillColor:   fill,
-		FontColor:   font,
-		StrokeColor: font,
-		FontSize:    14,
-	}))
+	for _, chart := range []*TimeChart{ui.chart, ui.solarChart, ui.detailChart} {
+		if chart != nil {
+			chart.SetTimeRange(now.Add(-span), now)
+		}
+	}
 }
 
-func (ui *EnergyUi) updateGraph() {
-	// Update colors for day/night mode
-	fill := drawing.Color{R: bgColor.R, G: bgColor.G, B: bgColor.B, A: bgColor.A}
-	font := drawing.Color{R: textColor.R, G: textColor.G, B: textColor.B, A: textColor.A}
-	ui.graph.Canvas.FillColor = fill
-	ui.graph.YAxis.Style.FontColor = font
-
-	// Recreate legend with updated colors
-	ui.graph.Elements = []chart.Renderable{chart.LegendLeft(ui.graph, chart.Style{
-		FillColor:   fill,
-		FontColor:   font,
-		StrokeColor: font,
-		FontSize:    14,
-	})}
-
-	// Update series data pointers
-	for _, device := range ui.deviceStates {
-		device.series.XValues = device.timestamps
-		if len(device.deviceConfig.Aggregate) == 0 {
-			device.series.YValues = device.values
-			continue
+// histories returns the history of each device for a range ending at now,
+// or nil if nothing changed since the last update. Ranges beyond the
+// in-memory history are read from the history store once a minute.
+func (ui *EnergyUi) histories(span time.Duration, now time.Time, changed bool) func(*EnergySensorState) EnergyHistory {
+	if span > time.Duration(config.Energy.MaxHistoryHours)*time.Hour {
+		if !changed && ui.persistedSpan == span && now.Sub(ui.persistedAt) < energyPersistedRefresh {
+			return nil
 		}
-
-		// Apply aggregation
-		aggregatedValues := make([]float64, len(device.values))
-
-		for i, v := range device.values {
-			t := device.timestamps[i]
-
-			newValue := v
-			for _, aggr := range device.deviceConfig.Aggregate {
-				// Find other device by uuid
-				var otherDevice *EnergySensorState
-				for _, d := range ui.deviceStates {
-					if d.deviceConfig.UUID == aggr.Device {
-						otherDevice = d
-						break
-					}
-				}
-				if otherDevice == nil {
-					// Other device not found skip aggregation task
-					continue
-				}
-
-				// Find latest value at or before timestamp of other device
-				otherDeviceValue := 0.0
-				for j := len(otherDevice.timestamps) - 1; j >= 0; j-- {
-					if !otherDevice.timestamps[j].After(t) {
-						otherDeviceValue = otherDevice.values[j]
-						break
-					}
-				}
-
-				switch aggr.Operation {
-				case AggrOpAdd:
-					newValue += otherDeviceValue
-				case AggrOpSub:
-					newValue -= otherDeviceValue
-				}
-			}
-
-			aggregatedValues[i] = newValue
+		ui.persistedAt, ui.persistedSpan = now, span
+		res := energyService.persistedHistory(now.Add(-span), now, span/1000)
+		return func(d *EnergySensorState) EnergyHistory {
+			return res[d]
 		}
-
-		device.series.YValues = aggregatedValues
 	}
 
-	// Reuse buffer
-	ui.renderBuf.Reset()
-	err := ui.graph.Render(chart.PNG, ui.renderBuf)
-	if err != nil {
-		log.Println("Could not render graph:", err)
-		return
+	version := uint64(0)
+	for _, device := range ui.deviceStates {
+		version += device.history.Version()
 	}
-
-	img, err := png.Decode(ui.renderBuf)
-	if err != nil {
-		log.Println("Could not decode graph png:", err)
-		return
+	if !changed && ui.persistedSpan == 0 && version == ui.version {
+		return nil
+	}
+	ui.version = version
+	ui.persistedSpan = 0
+	return func(d *EnergySensorState) EnergyHistory {
+		return d.history.Get()
 	}
+}
 
-	// Convert to RGBA reusing buffer and write pixels directly
-	bounds := img.Bounds()
-	draw.Draw(ui.rgbaBuf, bounds, img, bounds.Min, draw.Src)
-	ui.chartImage.WritePixels(ui.rgbaBuf.Pix)
+// chartProduction charts production upwards, whatever sign the plug
+// reports.
+func chartProduction(values []float64) []float64 {
+	res := make([]float64, len(values))
+	for i, v := range values {
+		res[i] = math.Abs(v)
+	}
+	return res
 }
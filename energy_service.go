@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fipso/screen-app/refoss"
+)
+
+// EnergyService polls all configured devices, independent of any energy
+// widget being on screen.
+type EnergyService struct {
+	// All series, virtual devices last
+	devices    []*EnergySensorState
+	virtuals   []*EnergySensorState
+	pollers    []*energyPoller
+	accounting EnergyAccounting
+}
+
+// EnergySensorState holds the history of one series, a device, one channel
+// of a multi channel device or a virtual device.
+type EnergySensorState struct {
+	device EnergyDevice
+	// id is the device ID, "<id>#<channel>" for channels
+	id        string
+	name      string
+	channel   int
+	aggregate []AggrTask
+	producer  bool
+	// Resolved aggregate tasks
+	aggrInputs []energyAggrInput
+	// Health of the device, nil for virtual devices
+	health *Observable[DeviceHealth]
+
+	// Virtual devices are computed from inputs, expr refers to input i by
+	// inputNames[i]
+	expr       exprNode
+	inputs     []*EnergySensorState
+	inputNames []string
+
+	history Observable[EnergyHistory]
+	// Latest reading of a real device, with voltage and current
+	reading Observable[PowerReading]
+}
+
+type energyAggrInput struct {
+	state *EnergySensorState
+	op    AggrOp
+}
+
+// EnergyHistory is a snapshot of the samples of one series, oldest first.
+type EnergyHistory struct {
+	timestamps []time.Time
+	// Device readings
+	values []float64
+	// values with aggregates applied, calculated once per sample. This is
+	// what charts, totals and automations use.
+	aggregated []float64
+}
+
+// index returns the index of the newest sample at or before t, -1 if there
+// is none.
+func (h EnergyHistory) index(t time.Time) int {
+	return sort.Search(len(h.timestamps), func(i int) bool {
+		return h.timestamps[i].After(t)
+	}) - 1
+}
+
+// energyPoller fetches all series of one device with a single request.
+type energyPoller struct {
+	device   EnergyDevice
+	states   []*EnergySensorState
+	channels bool
+	health   Observable[DeviceHealth]
+}
+
+func NewEnergyService(devices []EnergyDevice, virtual []VirtualEnergyDeviceConfig) *EnergyService {
+	s := &EnergyService{}
+	for _, device := range devices {
+		settings := device.settings()
+		p := &energyPoller{device: device, channels: len(settings.Channels) > 0}
+
+		if !p.channels {
+			st := newEnergySensorState(device, device.DeviceID(), settings.Name, 0, settings.Aggregate)
+			st.producer = settings.Producer
+			p.states = append(p.states, st)
+		}
+		for _, ch := range settings.Channels {
+			name := ch.Name
+			if name == "" {
+				name = fmt.Sprintf("%s %d", settings.Name, ch.Channel)
+			}
+			id := device.DeviceID() + "#" + strconv.Itoa(ch.Channel)
+			st := newEnergySensorState(device, id, name, ch.Channel, ch.Aggregate)
+			st.producer = settings.Producer || ch.Producer
+			p.states = append(p.states, st)
+		}
+
+		for _, st := range p.states {
+			st.health = &p.health
+		}
+		p.health.Set(DeviceHealth{State: DeviceOnline})
+		s.pollers = append(s.pollers, p)
+		s.devices = append(s.devices, p.states...)
+	}
+
+	for _, d := range s.devices {
+		for _, aggr := range d.aggregate {
+			other := s.device(aggr.Device)
+			if other == nil {
+				log.Printf("energy device %s: aggregate device %s not found", d.name, aggr.Device)
+				continue
+			}
+			d.aggrInputs = append(d.aggrInputs, energyAggrInput{state: other, op: aggr.Operation})
+		}
+	}
+
+	for _, cfg := range virtual {
+		v, err := s.newVirtualState(cfg)
+		if err != nil {
+			log.Printf("virtual energy device %s: %v", cfg.Name, err)
+			continue
+		}
+		s.virtuals = append(s.virtuals, v)
+		s.devices = append(s.devices, v)
+	}
+	return s
+}
+
+// newVirtualState parses the expression of a virtual device and resolves its
+// inputs. Virtual devices may use the virtual devices defined before them.
+func (s *EnergyService) newVirtualState(cfg VirtualEnergyDeviceConfig) (*EnergySensorState, error) {
+	expr, err := parseExpr(cfg.Expression)
+	if err != nil {
+		return nil, err
+	}
+
+	id := cfg.ID
+	if id == "" {
+		id = cfg.Name
+	}
+	v := &EnergySensorState{id: id, name: cfg.Name, expr: expr, producer: cfg.Producer}
+	for _, name := range exprVars(expr) {
+		input := s.device(name)
+		if input == nil {
+			input = s.deviceByName(name)
+		}
+		if input == nil {
+			return nil, fmt.Errorf("device %s not found", name)
+		}
+		v.inputs = append(v.inputs, input)
+		v.inputNames = append(v.inputNames, name)
+	}
+	return v, nil
+}
+
+func newEnergySensorState(device EnergyDevice, id, name string, channel int, aggregate []AggrTask) *EnergySensorState {
+	return &EnergySensorState{
+		device:    device,
+		id:        id,
+		name:      name,
+		channel:   channel,
+		aggregate: aggregate,
+	}
+}
+
+func (s *EnergyService) Run() {
+	httpService.HandleFunc("/energy/totals", s.accounting.serveTotals)
+	httpService.HandleFunc("/energy/health", s.serveHealth)
+
+	s.loadHistory()
+	s.accounting.load()
+	go func() {
+		for range time.Tick(time.Minute) {
+			s.accounting.save()
+		}
+	}()
+
+	for _, poller := range s.pollers {
+		if starter, ok := poller.device.(energyDeviceStarter); ok {
+			starter.start()
+		}
+		go func(p *energyPoller) {
+			for {
+				updated, at, err := s.fetch(p)
+				p.recordHealth(err)
+				if err == nil {
+					for _, d := range updated {
+						s.account(d)
+						s.publishDerived(d)
+					}
+					s.updateVirtuals(updated, at)
+				}
+				time.Sleep(p.nextPoll())
+			}
+		}(poller)
+	}
+}
+
+// loadHistory fills the in-memory history from the history store so charts
+// survive a restart.
+func (s *EnergyService) loadHistory() {
+	now := time.Now()
+	from := now.Add(-time.Hour * time.Duration(config.Energy.MaxHistoryHours))
+	for d, h := range s.persistedHistory(from, now, 0) {
+		d.history.Set(h)
+	}
+}
+
+// persistedHistory reads the history of all devices in [from, to] from the
+// history store and applies the aggregates. Resolution 0 reads raw samples,
+// longer ones minute or hour averages.
+func (s *EnergyService) persistedHistory(from, to time.Time, resolution time.Duration) map[*EnergySensorState]EnergyHistory {
+	res := map[*EnergySensorState]EnergyHistory{}
+	for _, d := range s.devices {
+		var h EnergyHistory
+		for _, p := range queryHistory(d.historySeries(), from, to, resolution) {
+			h.timestamps = append(h.timestamps, p.Time)
+			h.values = append(h.values, p.Avg)
+		}
+		// Own copy, both slices are appended to
+		h.aggregated = append([]float64(nil), h.values...)
+		res[d] = h
+	}
+
+	// Aggregates need the raw history of all devices
+	lookup := func(d *EnergySensorState) EnergyHistory {
+		return res[d]
+	}
+	for _, d := range s.devices {
+		if len(d.aggrInputs) == 0 {
+			continue
+		}
+		h := res[d]
+		for i := range h.values {
+			h.aggregated[i] = aggregateWith(d, h.timestamps[i], h.values[i], lookup)
+		}
+	}
+	return res
+}
+
+func (e *EnergySensorState) historySeries() string {
+	return "energy." + e.id
+}
+
+// account integrates the newest segment of d into the energy totals. It is
+// called by the poller of d, the only one adding samples to d, right after a
+// sample was added. Production is not billed.
+func (s *EnergyService) account(d *EnergySensorState) {
+	if d.producer {
+		return
+	}
+	h := d.history.Get()
+	n := len(h.aggregated)
+	if n < 2 {
+		return
+	}
+	s.accounting.add(d.name, h.timestamps[n-2], h.timestamps[n-1], h.aggregated[n-2], h.aggregated[n-1])
+}
+
+// publishDerived makes the latest value of d and the new total available to
+// automations.
+func (s *EnergyService) publishDerived(d *EnergySensorState) {
+	v, ok := d.latest()
+	if !ok {
+		return
+	}
+	derivedValues.Publish("energy:"+d.name, v)
+	derivedValues.Publish("energy:total", s.total())
+	if d.producer {
+		derivedValues.Publish("energy:production", s.production())
+	}
+	derivedValues.Publish("energy:net", s.net())
+}
+
+// total sums the latest aggregated value of every real consumer. Virtual
+// devices are left out as they are computed from the others.
+func (s *EnergyService) total() float64 {
+	usage := 0.0
+	for _, d := range s.devices {
+		if d.expr != nil || d.producer {
+			continue
+		}
+		v, _ := d.latest()
+		usage += v
+	}
+	return usage
+}
+
+// latest returns the newest aggregated value of d.
+func (d *EnergySensorState) latest() (float64, bool) {
+	h := d.history.Get()
+	n := len(h.aggregated)
+	if n == 0 {
+		return 0, false
+	}
+	return h.aggregated[n-1], true
+}
+
+// devicePower sums the latest power of all series of device.
+func (s *EnergyService) devicePower(device EnergyDevice) float64 {
+	watts := 0.0
+	for _, d := range s.devices {
+		if d.device == device {
+			v, _ := d.latest()
+			watts += v
+		}
+	}
+	return watts
+}
+
+func (s *EnergyService) device(id string) *EnergySensorState {
+	for _, d := range s.devices {
+		if d.id == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// deviceByName matches names case insensitive.
+func (s *EnergyService) deviceByName(name string) *EnergySensorState {
+	for _, d := range s.devices {
+		if strings.EqualFold(d.name, name) {
+			return d
+		}
+	}
+	return nil
+}
+
+// aggregateAt applies the device's aggregation tasks to its value v sampled
+// at t.
+func (s *EnergyService) aggregateAt(device *EnergySensorState, t time.Time, v float64) float64 {
+	return aggregateWith(device, t, v, func(d *EnergySensorState) EnergyHistory {
+		return d.history.Get()
+	})
+}
+
+// aggregateWith applies the aggregates of device to v, reading the other
+// devices from history.
+func aggregateWith(device *EnergySensorState, t time.Time, v float64, history func(*EnergySensorState) EnergyHistory) float64 {
+	for _, aggr := range device.aggrInputs {
+		// Latest value of the other device at or before t
+		other := history(aggr.state)
+		otherDeviceValue := 0.0
+		if i := other.index(t); i >= 0 {
+			otherDeviceValue = other.values[i]
+		}
+
+		switch aggr.op {
+		case AggrOpAdd:
+			v += otherDeviceValue
+		case AggrOpSub:
+			v -= otherDeviceValue
+		}
+	}
+
+	return v
+}
+
+func (d *RefossEnergyDeviceConfig) DeviceID() string {
+	return d.UUID
+}
+
+// client returns a LAN client for the device, signed with its profile key.
+func (d *RefossEnergyDeviceConfig) client() (*refoss.Client, error) {
+	key, ok := config.Energy.Profiles[d.Profile]
+	if !ok {
+		return nil, fmt.Errorf("meross profile %s not found", d.Profile)
+	}
+	return refoss.NewClient(d.Address, d.UUID, key), nil
+}
+
+// fetch reads the power of the poller's device and returns the series a
+// sample was added to and the time of the samples. Channels missing from the
+// readings are skipped.
+func (s *EnergyService) fetch(p *energyPoller) ([]*EnergySensorState, time.Time, error) {
+	timeout := time.Duration(p.device.settings().TimeoutMillis) * time.Millisecond
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var channels []int
+	if p.channels {
+		for _, st := range p.states {
+			channels = append(channels, st.channel)
+		}
+	}
+	readings, err := p.device.ReadPower(ctx, channels)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	now := time.Now()
+	var updated []*EnergySensorState
+	for _, st := range p.states {
+		for _, r := range readings {
+			if r.Channel == st.channel {
+				if s.addValue(st, now, r.Watts) {
+					updated = append(updated, st)
+				}
+				st.reading.Set(r)
+				recordSample(st.historySeries(), now, r.Watts)
+				break
+			}
+		}
+	}
+
+	return updated, now, nil
+}
+
+// addValue appends a reading p and its aggregated value. It returns false if
+// the sample was dropped.
+func (s *EnergyService) addValue(e *EnergySensorState, now time.Time, p float64) bool {
+	aggregated := s.aggregateAt(e, now, p)
+	appended := false
+	e.history.Update(func(h EnergyHistory) EnergyHistory {
+		// A sample computed concurrently from newer data won
+		if n := len(h.timestamps); n > 0 && now.Before(h.timestamps[n-1]) {
+			return h
+		}
+		appended = true
+
+		h.values = append(h.values, p)
+		h.aggregated = append(h.aggregated, aggregated)
+		h.timestamps = append(h.timestamps, now)
+
+		// Get history length
+		diff := now.Sub(h.timestamps[0])
+		if diff > time.Hour*time.Duration(config.Energy.MaxHistoryHours) {
+			// Drop oldest value
+			h.values = h.values[1:]
+			h.aggregated = h.aggregated[1:]
+			h.timestamps = h.timestamps[1:]
+		}
+		return h
+	})
+	return appended
+}
+
+// updateVirtuals computes a new sample at t of every virtual device
+// depending on one of the updated series, t being the time of their samples.
+func (s *EnergyService) updateVirtuals(updated []*EnergySensorState, t time.Time) {
+	changed := map[*EnergySensorState]bool{}
+	for _, d := range updated {
+		changed[d] = true
+	}
+
+	for _, v := range s.virtuals {
+		for _, input := range v.inputs {
+			if !changed[input] {
+				continue
+			}
+			if s.sampleVirtual(v, t) {
+				changed[v] = true
+				s.publishDerived(v)
+			}
+			break
+		}
+	}
+}
+
+// sampleVirtual evaluates v with the latest input values at or before t. It
+// returns false while an input has no data yet or if a newer sample of v was
+// added concurrently.
+func (s *EnergyService) sampleVirtual(v *EnergySensorState, t time.Time) bool {
+	vars := make(map[string]float64, len(v.inputs))
+	for i, input := range v.inputs {
+		h := input.history.Get()
+		j := h.index(t)
+		if j < 0 {
+			return false
+		}
+		vars[v.inputNames[i]] = h.aggregated[j]
+	}
+
+	value := v.expr.eval(vars)
+	if !s.addValue(v, t, value) {
+		return false
+	}
+	recordSample(v.historySeries(), t, value)
+	return true
+}
+
+func (d *RefossEnergyDeviceConfig) ReadPower(ctx context.Context, channels []int) ([]PowerReading, error) {
+	client, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+	return readRefossPower(ctx, client, channels)
+}
+
+func readRefossPower(ctx context.Context, client *refoss.Client, channels []int) ([]PowerReading, error) {
+	var readings []refoss.Electricity
+	var err error
+	if len(channels) > 0 {
+		readings, err = client.ElectricityX(ctx, channels)
+	} else {
+		var e refoss.Electricity
+		e, err = client.Electricity(ctx, 0)
+		readings = []refoss.Electricity{e}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]PowerReading, len(readings))
+	for i, e := range readings {
+		res[i] = refossReading(e)
+	}
+	return res, nil
+}
+
+func refossReading(e refoss.Electricity) PowerReading {
+	return PowerReading{
+		Channel: e.Channel,
+		Watts:   e.Watts(),
+		Volts:   e.Volts(),
+		Amps:    e.Amps(),
+		Factor:  e.Factor,
+	}
+}
+
+func (d *RefossEnergyDeviceConfig) SetPlugState(on bool) error {
+	client, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return d.setPlugState(ctx, client, on)
+}
+
+func (d *RefossEnergyDeviceConfig) setPlugState(ctx context.Context, client *refoss.Client, on bool) error {
+	if err := client.ToggleX(ctx, d.SwitchChannel, on); err != nil {
+		return fmt.Errorf("plug %s set state failed: %w", d.UUID, err)
+	}
+	plugStates.set(d.UUID, on)
+
+	return nil
+}
+
+// ReadPlugState reads the relay state from System.All.
+func (d *RefossEnergyDeviceConfig) ReadPlugState(ctx context.Context) (bool, error) {
+	client, err := d.client()
+	if err != nil {
+		return false, err
+	}
+	return d.readPlugState(ctx, client)
+}
+
+func (d *RefossEnergyDeviceConfig) readPlugState(ctx context.Context, client *refoss.Client) (bool, error) {
+	all, err := client.SystemAll(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, t := range all.All.Digest.ToggleX {
+		if t.Channel == d.SwitchChannel {
+			return t.On(), nil
+		}
+	}
+	return false, fmt.Errorf("plug %s has no channel %d", d.UUID, d.SwitchChannel)
+}
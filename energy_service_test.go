@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/fipso/screen-app/refoss"
+	"github.com/fipso/screen-app/refoss/refosstest"
+)
+
+func newFakeRefoss(t *testing.T) (*refosstest.Device, *RefossEnergyDeviceConfig) {
+	t.Helper()
+	d := refosstest.NewDevice("uuid", "key")
+	t.Cleanup(d.Close)
+
+	config.Energy.Profiles = map[string]string{"home": "key"}
+	config.Energy.MaxHistoryHours = 6
+	return d, &RefossEnergyDeviceConfig{
+		EnergyDeviceBase: EnergyDeviceBase{Name: "desk"},
+		Address:          d.Server.URL,
+		UUID:             "uuid",
+		Profile:          "home",
+	}
+}
+
+func TestEnergyPollerFetch(t *testing.T) {
+	d, cfg := newFakeRefoss(t)
+	s := NewEnergyService([]EnergyDevice{cfg}, nil)
+	p, st := s.pollers[0], s.devices[0]
+
+	d.SetPower(0, 120.5, 230, 0.5)
+	if _, _, err := s.fetch(p); err != nil {
+		t.Fatal(err)
+	}
+	d.SetPower(0, 80, 230, 0.3)
+	if _, _, err := s.fetch(p); err != nil {
+		t.Fatal(err)
+	}
+	h := st.history.Get()
+	if len(h.values) != 2 || h.values[0] != 120.5 || h.values[1] != 80 || len(h.timestamps) != 2 {
+		t.Fatalf("got values %v", h.values)
+	}
+
+	d.FailWith(5000)
+	var deviceErr *refoss.DeviceError
+	if _, _, err := s.fetch(p); !errors.As(err, &deviceErr) {
+		t.Errorf("got %v, want DeviceError", err)
+	}
+	if h := st.history.Get(); len(h.values) != 2 {
+		t.Errorf("failed fetch added a value: %v", h.values)
+	}
+}
+
+func TestEnergyPollerChannels(t *testing.T) {
+	d, cfg := newFakeRefoss(t)
+	cfg.Channels = []EnergyChannelConfig{{Channel: 1, Name: "oven"}, {Channel: 3}}
+	s := NewEnergyService([]EnergyDevice{cfg}, nil)
+	if len(s.pollers) != 1 || len(s.devices) != 2 {
+		t.Fatalf("got %d pollers and %d series, want 1 and 2", len(s.pollers), len(s.devices))
+	}
+
+	d.SetPower(1, 2000, 230, 8.7)
+	d.SetPower(2, 50, 230, 0.2)
+	d.SetPower(3, 300, 230, 1.3)
+	if _, _, err := s.fetch(s.pollers[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.Requests()); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+
+	tests := []struct {
+		id, name string
+		watts    float64
+	}{
+		{"uuid#1", "oven", 2000},
+		{"uuid#3", "desk 3", 300},
+	}
+	for _, tt := range tests {
+		st := s.device(tt.id)
+		if st == nil {
+			t.Errorf("series %s missing", tt.id)
+			continue
+		}
+		h := st.history.Get()
+		if st.name != tt.name || len(h.values) != 1 || h.values[0] != tt.watts {
+			t.Errorf("%s: got %s %v, want %s %v", tt.id, st.name, h.values, tt.name, tt.watts)
+		}
+	}
+}
+
+func TestRefossSetPlugState(t *testing.T) {
+	d, cfg := newFakeRefoss(t)
+	cfg.SwitchChannel = 2
+
+	for _, on := range []bool{true, false} {
+		if err := cfg.SetPlugState(on); err != nil {
+			t.Fatal(err)
+		}
+		if d.On(2) != on {
+			t.Errorf("plug is %v, want %v", d.On(2), on)
+		}
+		// The plugs widget reads the relay state back
+		if got, err := cfg.ReadPlugState(context.Background()); err != nil || got != on {
+			t.Errorf("read plug state %v, %v, want %v", got, err, on)
+		}
+	}
+	if d.On(0) {
+		t.Errorf("channel 0 switched")
+	}
+
+	cfg.SwitchChannel = 5
+	if _, err := cfg.ReadPlugState(context.Background()); err == nil {
+		t.Errorf("no error for a missing channel")
+	}
+
+	cfg.Profile = "unknown"
+	if err := cfg.SetPlugState(true); err == nil {
+		t.Errorf("no error for an unknown profile")
+	}
+}
+
+// fakeMeter is an energy device reading a fixed power on channel 0, or
+// readings if set. Its plug fails with err if set, switched receives the
+// states if set.
+type fakeMeter struct {
+	EnergyDeviceBase
+	watts    float64
+	readings []PowerReading
+	on       bool
+	switches int
+	err      error
+	switched chan bool
+}
+
+func (m *fakeMeter) DeviceID() string            { return m.Name }
+func (m *fakeMeter) settings() *EnergyDeviceBase { return &m.EnergyDeviceBase }
+func (m *fakeMeter) ReadPower(ctx context.Context, channels []int) ([]PowerReading, error) {
+	if m.readings != nil {
+		return m.readings, nil
+	}
+	return []PowerReading{{Watts: m.watts}}, nil
+}
+
+func (m *fakeMeter) SetPlugState(on bool) error {
+	if m.switched != nil {
+		m.switched <- on
+		return nil
+	}
+	m.switches++
+	if m.err != nil {
+		return m.err
+	}
+	m.on = on
+	return nil
+}
+
+// poll does what the poller goroutine of Run does after a reading.
+func poll(t *testing.T, s *EnergyService, p *energyPoller) {
+	t.Helper()
+	updated, at, err := s.fetch(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range updated {
+		s.account(d)
+		s.publishDerived(d)
+	}
+	s.updateVirtuals(updated, at)
+}
+
+func TestVirtualDevices(t *testing.T) {
+	config.Energy.MaxHistoryHours = 6
+	solar := &fakeMeter{EnergyDeviceBase: EnergyDeviceBase{Name: "solar"}}
+	house := &fakeMeter{EnergyDeviceBase: EnergyDeviceBase{Name: "house"}}
+	s := NewEnergyService([]EnergyDevice{solar, house}, []VirtualEnergyDeviceConfig{
+		{Name: "surplus", Expression: "max(0, solar - house)"},
+		// Virtual devices can use the ones defined before them
+		{Name: "surplus kw", Expression: "surplus / 1000"},
+	})
+	surplus, surplusKW := s.deviceByName("surplus"), s.deviceByName("surplus kw")
+
+	var published []float64
+	derivedValues.On("energy:surplus", func(v float64) {
+		published = append(published, v)
+	})
+
+	// Nothing is computed until every input has data
+	solar.watts = 3000
+	poll(t, s, s.pollers[0])
+	if n := len(surplus.history.Get().values); n != 0 {
+		t.Fatalf("got %d samples without house data", n)
+	}
+
+	house.watts = 1200
+	poll(t, s, s.pollers[1])
+	solar.watts = 800
+	poll(t, s, s.pollers[0])
+
+	want := []float64{1800, 0}
+	if got := surplus.history.Get().values; !floatsEqual(got, want) {
+		t.Errorf("surplus: got %v, want %v", got, want)
+	}
+	if got := surplusKW.history.Get().values; !floatsEqual(got, []float64{1.8, 0}) {
+		t.Errorf("surplus kw: got %v, want [1.8 0]", got)
+	}
+	// Computed and published once per input sample
+	if !floatsEqual(published, want) {
+		t.Errorf("published %v, want %v", published, want)
+	}
+	if total := s.total(); total != 2000 {
+		t.Errorf("total %v includes virtual devices", total)
+	}
+
+	// Stamped with the time of the sample they were computed from
+	wantAt := []time.Time{
+		s.deviceByName("house").history.Get().timestamps[0],
+		s.deviceByName("solar").history.Get().timestamps[1],
+	}
+	for _, d := range []*EnergySensorState{surplus, surplusKW} {
+		got := d.history.Get().timestamps
+		if len(got) != 2 || !got[0].Equal(wantAt[0]) || !got[1].Equal(wantAt[1]) {
+			t.Errorf("%s: got timestamps %v, want %v", d.name, got, wantAt)
+		}
+	}
+}
+
+func TestVirtualDeviceAutomationInput(t *testing.T) {
+	config.Energy.MaxHistoryHours = 6
+	solar := &fakeMeter{EnergyDeviceBase: EnergyDeviceBase{Name: "pv"}, watts: 2500}
+	house := &fakeMeter{EnergyDeviceBase: EnergyDeviceBase{Name: "home"}, watts: 500}
+	s := NewEnergyService([]EnergyDevice{solar, house}, []VirtualEnergyDeviceConfig{
+		{Name: "export", Expression: "pv - home"},
+	})
+
+	// Subscribed like AutomationService.Run does for inputs
+	a := &AutomationService{simulate: true}
+	a.init([]AutomationConfig{{
+		Name:             "boiler",
+		Input:            "energy:export",
+		Operator:         AutomationOpAbove,
+		Threshold:        1000,
+		OnTriggerActions: []AutomationAction{{Type: AutomationActionPlug, DeviceUUID: "boiler", State: true}},
+	}}, time.Now().Add(-time.Hour))
+	derivedValues.On("energy:export", func(v float64) {
+		a.handleValue(a.byInput["energy:export"], v)
+	})
+
+	poll(t, s, s.pollers[0])
+	poll(t, s, s.pollers[1])
+
+	if len(a.events) != 1 || !a.events[0].on {
+		t.Errorf("got switches %+v, want the boiler switched on", a.events)
+	}
+	if st := a.states["boiler"]; st.lastValue != 2000 {
+		t.Errorf("automation saw %v, want 2000", st.lastValue)
+	}
+}
+
+func floatsEqual(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAccountMissingChannel(t *testing.T) {
+	config.Energy.MaxHistoryHours = 6
+	m := &fakeMeter{EnergyDeviceBase: EnergyDeviceBase{
+		Name:     "rack",
+		Channels: []EnergyChannelConfig{{Channel: 1, Name: "nas"}, {Channel: 2, Name: "router"}},
+	}}
+	s := NewEnergyService([]EnergyDevice{m}, nil)
+	p := s.pollers[0]
+	now := time.Now()
+	kWh := func(device string) float64 {
+		return s.accounting.DeviceTotals(now.AddDate(0, 0, -1), now.AddDate(0, 0, 2))[device].KWh
+	}
+
+	m.readings = []PowerReading{{Channel: 1, Watts: 1000}, {Channel: 2, Watts: 1000}}
+	poll(t, s, p)
+	time.Sleep(10 * time.Millisecond)
+	poll(t, s, p)
+	router := kWh("router")
+	if router <= 0 {
+		t.Fatalf("router segment not integrated")
+	}
+
+	// The router is missing from the next reading, its last segment must
+	// not be integrated again
+	m.readings = m.readings[:1]
+	time.Sleep(10 * time.Millisecond)
+	poll(t, s, p)
+	if got := kWh("router"); got != router {
+		t.Errorf("router got %v kWh, want %v", got, router)
+	}
+	if kWh("nas") <= router {
+		t.Errorf("nas segment not integrated")
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportService makes the collected data available to other tools: a CSV
+// download, a Prometheus endpoint and an InfluxDB push.
+type ExportService struct {
+	client *http.Client
+	// Energy samples up to this time have been pushed to InfluxDB
+	pushedUntil map[*EnergySensorState]time.Time
+}
+
+func (s *ExportService) Run() {
+	httpService.HandleFunc("/energy/export.csv", s.serveCSV)
+	httpService.HandleFunc("/metrics", s.serveMetrics)
+
+	cfg := config.Export.Influx
+	if cfg.URL == "" {
+		return
+	}
+	interval := time.Duration(cfg.IntervalSeconds) * time.Second
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	s.client = &http.Client{Timeout: 10 * time.Second}
+	s.pushedUntil = map[*EnergySensorState]time.Time{}
+	for _, d := range energyService.devices {
+		s.pushedUntil[d] = time.Now()
+	}
+	for range time.Tick(interval) {
+		if err := s.pushInflux(); err != nil {
+			log.Println("Could not push to InfluxDB:", err)
+		}
+	}
+}
+
+// serveCSV handles GET /energy/export.csv?device=<id or name>&from=&to=&resolution=.
+// from and to are RFC 3339 and default to the last 24 hours, resolution is
+// a duration like 1m and defaults to the raw samples.
+func (s *ExportService) serveCSV(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	d := energyService.device(q.Get("device"))
+	if d == nil {
+		d = energyService.deviceByName(q.Get("device"))
+	}
+	if d == nil {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	var resolution time.Duration
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("resolution"); v != "" {
+		if resolution, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "invalid resolution", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", d.id+".csv"))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "avg_watts", "min_watts", "max_watts", "samples"})
+	for _, p := range queryHistory(d.historySeries(), from, to, resolution) {
+		cw.Write([]string{
+			p.Time.Format(time.RFC3339),
+			strconv.FormatFloat(p.Avg, 'f', 2, 64),
+			strconv.FormatFloat(p.Min, 'f', 2, 64),
+			strconv.FormatFloat(p.Max, 'f', 2, 64),
+			strconv.FormatInt(p.Count, 10),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Println("Could not write CSV export:", err)
+	}
+}
+
+// serveMetrics handles GET /metrics in the Prometheus text format.
+func (s *ExportService) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+
+	metric := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	sample := func(name, labels string, v float64) {
+		fmt.Fprintf(&b, "%s{%s} %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+
+	metric("screen_energy_watts", "Latest power of an energy device.")
+	for _, d := range energyService.devices {
+		if v, ok := d.latest(); ok {
+			sample("screen_energy_watts", d.promLabels(), v)
+		}
+	}
+	metric("screen_energy_volts", "Latest voltage of an energy device.")
+	for _, d := range energyService.devices {
+		if r, version := d.reading.Snapshot(); version > 0 && r.Volts != 0 {
+			sample("screen_energy_volts", d.promLabels(), r.Volts)
+		}
+	}
+	metric("screen_energy_amps", "Latest current of an energy device.")
+	for _, d := range energyService.devices {
+		// Devices without voltage report no current either
+		if r, version := d.reading.Snapshot(); version > 0 && r.Volts != 0 {
+			sample("screen_energy_amps", d.promLabels(), r.Amps)
+		}
+	}
+	metric("screen_energy_total_watts", "Sum of all real energy devices.")
+	fmt.Fprintf(&b, "screen_energy_total_watts %s\n", strconv.FormatFloat(energyService.total(), 'g', -1, 64))
+
+	for _, m := range []struct{ prefix, name, help string }{
+		{"temp:", "screen_grow_temperature_celsius", "Grow sensor temperature."},
+		{"rh:", "screen_grow_humidity_percent", "Grow sensor relative humidity."},
+		{"vpd:", "screen_grow_vpd_kpa", "Grow sensor vapour pressure deficit."},
+	} {
+		metric(m.name, m.help)
+		for _, sensor := range config.Grow.Sensors {
+			if v, ok := derivedValues.Get(m.prefix + sensor.Name); ok {
+				sample(m.name, promLabel("sensor", sensor.Name), v)
+			}
+		}
+	}
+
+	statuses := automationService.status()
+	metric("screen_automation_on", "1 if the automation switched its devices on.")
+	for _, a := range statuses {
+		sample("screen_automation_on", promLabel("automation", a.Name), boolFloat(a.On))
+	}
+	metric("screen_automation_triggered", "1 while the automation condition is true.")
+	for _, a := range statuses {
+		sample("screen_automation_triggered", promLabel("automation", a.Name), boolFloat(a.Triggered))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+func (d *EnergySensorState) promLabels() string {
+	return promLabel("device", d.name) + "," + promLabel("id", d.id)
+}
+
+func promLabel(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return fmt.Sprintf("%s=%q", name, value)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// pushInflux writes all energy samples since the last push and the current
+// grow and automation values.
+func (s *ExportService) pushInflux() error {
+	var b bytes.Buffer
+	now := time.Now()
+	until := map[*EnergySensorState]time.Time{}
+
+	for _, d := range energyService.devices {
+		h := d.history.Get()
+		until[d] = s.pushedUntil[d]
+		for i := h.index(s.pushedUntil[d]) + 1; i < len(h.timestamps); i++ {
+			fmt.Fprintf(&b, "energy,device=%s,id=%s watts=%g %d\n",
+				influxTag(d.name), influxTag(d.id), h.aggregated[i], h.timestamps[i].UnixNano())
+			until[d] = h.timestamps[i]
+		}
+		if r, version := d.reading.Snapshot(); version > 0 && r.Volts != 0 {
+			fmt.Fprintf(&b, "electricity,device=%s,id=%s volts=%g,amps=%g,factor=%g %d\n",
+				influxTag(d.name), influxTag(d.id), r.Volts, r.Amps, r.Factor, now.UnixNano())
+		}
+	}
+
+	for _, sensor := range config.Grow.Sensors {
+		var fields []string
+		for _, f := range []struct{ prefix, field string }{{"temp:", "temp"}, {"rh:", "rh"}, {"vpd:", "vpd"}} {
+			if v, ok := derivedValues.Get(f.prefix + sensor.Name); ok {
+				fields = append(fields, fmt.Sprintf("%s=%g", f.field, v))
+			}
+		}
+		if len(fields) > 0 {
+			fmt.Fprintf(&b, "grow,sensor=%s %s %d\n", influxTag(sensor.Name), strings.Join(fields, ","), now.UnixNano())
+		}
+	}
+
+	statuses := automationService.status()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	for _, a := range statuses {
+		fmt.Fprintf(&b, "automation,name=%s on=%t,triggered=%t %d\n", influxTag(a.Name), a.On, a.Triggered, now.UnixNano())
+	}
+
+	if b.Len() == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.Export.Influx.URL, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if config.Export.Influx.Token != "" {
+		req.Header.Set("Authorization", "Token "+config.Export.Influx.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%d: %s", resp.StatusCode, string(body))
+	}
+
+	s.pushedUntil = until
+	return nil
+}
+
+// influxTag escapes a tag value for the line protocol.
+func influxTag(v string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(v)
+}
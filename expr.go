@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprNode is a parsed arithmetic expression over named values, used by
+// virtual energy devices, e.g. "max(0, solar - house)".
+type exprNode interface {
+	eval(vars map[string]float64) float64
+}
+
+type (
+	exprNumber float64
+	exprVar    string
+	exprNeg    struct{ x exprNode }
+	exprBinary struct {
+		op   byte
+		x, y exprNode
+	}
+	exprCall struct {
+		fn   string
+		args []exprNode
+	}
+)
+
+func (n exprNumber) eval(map[string]float64) float64 { return float64(n) }
+
+func (n exprVar) eval(vars map[string]float64) float64 { return vars[string(n)] }
+
+func (n exprNeg) eval(vars map[string]float64) float64 { return -n.x.eval(vars) }
+
+func (n exprBinary) eval(vars map[string]float64) float64 {
+	x, y := n.x.eval(vars), n.y.eval(vars)
+	switch n.op {
+	case '+':
+		return x + y
+	case '-':
+		return x - y
+	case '*':
+		return x * y
+	case '/':
+		// Keep charts and totals finite
+		if y == 0 {
+			return 0
+		}
+		return x / y
+	}
+	return 0
+}
+
+func (n exprCall) eval(vars map[string]float64) float64 {
+	res := n.args[0].eval(vars)
+	for _, arg := range n.args[1:] {
+		v := arg.eval(vars)
+		switch n.fn {
+		case "min":
+			res = math.Min(res, v)
+		case "max":
+			res = math.Max(res, v)
+		}
+	}
+	if n.fn == "abs" {
+		res = math.Abs(res)
+	}
+	return res
+}
+
+// exprVars lists the names used in n, each once.
+func exprVars(n exprNode) []string {
+	var names []string
+	seen := map[string]bool{}
+	var walk func(exprNode)
+	walk = func(n exprNode) {
+		switch n := n.(type) {
+		case exprVar:
+			if !seen[string(n)] {
+				seen[string(n)] = true
+				names = append(names, string(n))
+			}
+		case exprNeg:
+			walk(n.x)
+		case exprBinary:
+			walk(n.x)
+			walk(n.y)
+		case exprCall:
+			for _, arg := range n.args {
+				walk(arg)
+			}
+		}
+	}
+	walk(n)
+	return names
+}
+
+// parseExpr parses + - * /, parentheses, numbers, names and the functions
+// min, max and abs. Names containing spaces are quoted like 'living room'.
+func parseExpr(s string) (exprNode, error) {
+	p := &exprParser{src: s}
+	n, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at %d", p.src[p.pos], p.pos)
+	}
+	return n, nil
+}
+
+type exprParser struct {
+	src string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// peek returns the next non space byte, 0 at the end.
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	x, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		y, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		x = exprBinary{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = exprBinary{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprNeg{x: x}, nil
+	}
+	return p.parseOperand()
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+
+	case c == '(':
+		p.pos++
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at %d", p.pos)
+		}
+		p.pos++
+		return x, nil
+
+	case c == '\'':
+		end := strings.IndexByte(p.src[p.pos+1:], '\'')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated name at %d", p.pos)
+		}
+		name := p.src[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return exprVar(name), nil
+
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, err
+		}
+		return exprNumber(v), nil
+
+	case isExprNameByte(c):
+		start := p.pos
+		for p.pos < len(p.src) && (isExprNameByte(p.src[p.pos]) || p.src[p.pos] >= '0' && p.src[p.pos] <= '9') {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.peek() != '(' {
+			return exprVar(name), nil
+		}
+		return p.parseCall(name)
+	}
+
+	return nil, fmt.Errorf("unexpected %q at %d", c, p.pos)
+}
+
+func (p *exprParser) parseCall(fn string) (exprNode, error) {
+	switch fn {
+	case "min", "max", "abs":
+	default:
+		return nil, fmt.Errorf("unknown function %s", fn)
+	}
+
+	// Skip "("
+	p.pos++
+	var args []exprNode
+	for {
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		c := p.peek()
+		p.pos++
+		if c == ')' {
+			break
+		}
+		if c != ',' {
+			return nil, fmt.Errorf("expected , or ) at %d", p.pos-1)
+		}
+	}
+	if fn == "abs" && len(args) != 1 {
+		return nil, fmt.Errorf("abs takes one argument")
+	}
+	return exprCall{fn: fn, args: args}, nil
+}
+
+func isExprNameByte(c byte) bool {
+	return c == '_' || c == '#' || unicode.IsLetter(rune(c))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	vars := map[string]float64{
+		"solar":       3000,
+		"house":       1200,
+		"living room": 150,
+		"plug_2":      40,
+	}
+
+	tests := []struct {
+		expr string
+		want float64
+		vars []string
+	}{
+		{"1", 1, nil},
+		{"1.5 + 2", 3.5, nil},
+		{"solar - house", 1800, []string{"solar", "house"}},
+		{"2 + 3 * 4", 14, nil},
+		{"(2 + 3) * 4", 20, nil},
+		{"10 - 4 - 3", 3, nil},
+		{"12 / 3 / 2", 2, nil},
+		{"-house + 200", -1000, []string{"house"}},
+		{"--5", 5, nil},
+		{"solar / 0", 0, []string{"solar"}},
+		{"max(0, house - solar)", 0, []string{"house", "solar"}},
+		{"min(solar, house, 500)", 500, []string{"solar", "house"}},
+		{"abs(house - solar)", 1800, []string{"house", "solar"}},
+		{"'living room' + plug_2", 190, []string{"living room", "plug_2"}},
+		{"house + house", 2400, []string{"house"}},
+		{"unknown", 0, []string{"unknown"}},
+	}
+	for _, tt := range tests {
+		n, err := parseExpr(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := n.eval(vars); got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.expr, got, tt.want)
+		}
+		if got := exprVars(n); !reflect.DeepEqual(got, tt.vars) {
+			t.Errorf("%q uses %v, want %v", tt.expr, got, tt.vars)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 2",
+		"'living room",
+		"sqrt(4)",
+		"abs(1, 2)",
+		"max(1 2)",
+		"1..2",
+		"solar $ house",
+	} {
+		if _, err := parseExpr(expr); err == nil {
+			t.Errorf("%q: no error", expr)
+		}
+	}
+}
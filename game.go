@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
 	"golang.org/x/image/font"
 	"golang.org/x/image/font/basicfont"
 	"golang.org/x/image/font/opentype"
@@ -18,6 +19,12 @@ type UiElement interface {
 	Draw() *ebiten.Image
 }
 
+// Tappable is implemented by elements that react to touch or mouse input.
+// x and y are relative to the element.
+type Tappable interface {
+	Tap(x, y int)
+}
+
 // Ebiten units
 // const config.Width = 360 / 2
 // const config.Height = 640 / 2
@@ -46,14 +53,46 @@ var (
 )
 
 type Game struct {
-	stackLayout  []UiElement
-	currentModal UiElement
+	stackLayout []UiElement
+	// Set by alerts from service goroutines, read by the render loop
+	currentModal Observable[UiElement]
 }
 
 func (g *Game) Update() error {
+	if x, y, ok := justTapped(); ok && g.currentModal.Get() == nil {
+		tapStackLayout(g.stackLayout, x, y)
+	}
 	return nil
 }
 
+func justTapped() (x, y int, ok bool) {
+	if inpututil.IsMouseButtonJustPressed(ebiten.MouseButtonLeft) {
+		x, y = ebiten.CursorPosition()
+		return x, y, true
+	}
+	for _, id := range inpututil.AppendJustPressedTouchIDs(nil) {
+		x, y = ebiten.TouchPosition(id)
+		return x, y, true
+	}
+	return 0, 0, false
+}
+
+// tapStackLayout forwards a tap to the element below it, using the same
+// positions as drawStackLayout.
+func tapStackLayout(elements []UiElement, x, y int) {
+	top := 0
+	for _, ui := range elements {
+		_, height := ui.Bounds()
+		if y >= top && y < top+height {
+			if t, ok := ui.(Tappable); ok {
+				t.Tap(x-paddingX, y-top)
+			}
+			return
+		}
+		top += height + linePadding
+	}
+}
+
 func (g *Game) Draw(screen *ebiten.Image) {
 	screen.Fill(bgColor)
 
@@ -61,8 +100,8 @@ func (g *Game) Draw(screen *ebiten.Image) {
 	drawStackLayout(screen, g.stackLayout)
 
 	// Draw modal if any
-	if g.currentModal != nil {
-		modalOverlay := g.currentModal.Draw()
+	if modal := g.currentModal.Get(); modal != nil {
+		modalOverlay := modal.Draw()
 		// Draw ontop of existing screen (with alpha transparency)
 		screen.DrawImage(modalOverlay, &ebiten.DrawImageOptions{})
 	}
@@ -117,6 +156,16 @@ func parseUiElement(configElem LayoutElement) *UiElement {
 		element = &CryptoUi{}
 	case LayoutElementEnergy:
 		element = &EnergyUi{}
+	case LayoutElementControllers:
+		element = &ControllerUi{}
+	case LayoutElementAutomations:
+		element = &AutomationUi{}
+	case LayoutElementCost:
+		element = &CostUi{}
+	case LayoutElementPrices:
+		element = &PriceUi{}
+	case LayoutElementPlugs:
+		element = &PlugUi{}
 	default:
 		log.Fatalf("CONFIG | Unknown layout element type: %s", configElem.Type)
 	}
@@ -125,8 +174,6 @@ func parseUiElement(configElem LayoutElement) *UiElement {
 }
 
 func runGameUI() {
-	game = &Game{}
-
 	// Build UI Layout from config
 	for _, layoutElement := range config.Layout {
 		element := parseUiElement(layoutElement)
@@ -5,7 +5,6 @@ import (
 	"log"
 	"strconv"
 	"strings"
-	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/hajimehoshi/ebiten/v2"
@@ -16,41 +15,43 @@ type GrowUi struct {
 	screen *ebiten.Image
 
 	vpdChart   *VPDChart
-	sensorData []SensorData
+	sensorData Observable[[]SensorData]
 }
 
+// SensorData holds the latest values, the history is kept in the history
+// store (see runGrowDerivedValues).
 type SensorData struct {
-	tempLast     float64
-	humidLast    float64
-	tempHistory  map[time.Time]float64
-	humidHistory map[time.Time]float64
+	tempLast  float64
+	humidLast float64
 }
 
 func (ui *GrowUi) messagePubHandler(client mqtt.Client, msg mqtt.Message) {
-	for i, sensor := range config.Grow.Sensors {
-		v, err := parseValue(msg)
-		if err != nil {
-			log.Println("Could not parse MQTT message", v)
-		}
-		if msg.Topic() == sensor.Temp {
-			ui.sensorData[i].tempLast = v
-			ui.sensorData[i].tempHistory[time.Now()] = v
-			ui.vpdChart.Update(i, ui.sensorData[i].tempLast, ui.sensorData[i].humidLast)
-		}
-		if msg.Topic() == sensor.Humid {
-			ui.sensorData[i].humidLast = v
-			ui.sensorData[i].humidHistory[time.Now()] = v
-			ui.vpdChart.Update(i, ui.sensorData[i].tempLast, ui.sensorData[i].humidLast)
+	ui.sensorData.Update(func(old []SensorData) []SensorData {
+		data := append([]SensorData(nil), old...)
+		for i, sensor := range config.Grow.Sensors {
+			v, err := parseValue(msg)
+			if err != nil {
+				log.Println("Could not parse MQTT message", v)
+			}
+			if msg.Topic() == sensor.Temp {
+				data[i].tempLast = v
+				ui.vpdChart.Update(i, data[i].tempLast, data[i].humidLast)
+			}
+			if msg.Topic() == sensor.Humid {
+				data[i].humidLast = v
+				ui.vpdChart.Update(i, data[i].tempLast, data[i].humidLast)
+			}
 		}
-	}
+		return data
+	})
 
-	if weatherCurrentData != nil {
+	if current := weatherCurrentData.Get(); current != nil {
 		// Update virtual outdoor sensor
-		lastIndex := len(ui.sensorData) // No -1 because we added the virtual sensor
+		lastIndex := len(config.Grow.Sensors) // No -1 because we added the virtual sensor
 		ui.vpdChart.Update(
 			lastIndex,
-			weatherCurrentData.Weather.Temperature,
-			weatherCurrentData.Weather.RelativeHumidity,
+			current.Weather.Temperature,
+			current.Weather.RelativeHumidity,
 		)
 	}
 
@@ -323,13 +324,8 @@ func (ui *GrowUi) Init() {
 	var sensorNames []string
 	for _, s := range config.Grow.Sensors {
 		sensorNames = append(sensorNames, s.Name)
-		ui.sensorData = append(ui.sensorData, SensorData{
-			tempLast:     0,
-			humidLast:    0,
-			tempHistory:  make(map[time.Time]float64),
-			humidHistory: make(map[time.Time]float64),
-		})
 	}
+	ui.sensorData.Set(make([]SensorData, len(config.Grow.Sensors)))
 	// Init virtual outdoor sensor
 	sensorNames = append(sensorNames, "Outdoor")
 
@@ -384,14 +380,15 @@ func (ui *GrowUi) Draw() *ebiten.Image {
 		GeoM: pos,
 	})
 
+	sensorData := ui.sensorData.Get()
 	for i, sensor := range config.Grow.Sensors {
 		text.Draw(
 			ui.screen,
 			fmt.Sprintf(
 				"%s\n%.2f temp %.2f rh",
 				strings.ToLower(sensor.Name),
-				ui.sensorData[i].tempLast,
-				ui.sensorData[i].humidLast,
+				sensorData[i].tempLast,
+				sensorData[i].humidLast,
 			),
 			defaultFont,
 			0,
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+type DeviceHealthState string
+
+const (
+	DeviceOnline DeviceHealthState = "online"
+	// Some polls failed recently
+	DeviceDegraded DeviceHealthState = "degraded"
+	DeviceOffline  DeviceHealthState = "offline"
+)
+
+// Consecutive failures until a device counts as offline
+const offlineAfterFailures = 3
+
+const maxPollBackoff = time.Minute
+
+type DeviceHealth struct {
+	State       DeviceHealthState `json:"state"`
+	LastError   string            `json:"lastError,omitempty"`
+	LastErrorAt time.Time         `json:"lastErrorAt,omitempty"`
+	LastSuccess time.Time         `json:"lastSuccess,omitempty"`
+	Failures    int               `json:"failures"`
+}
+
+// recordHealth updates the health after a poll. Only state changes are
+// logged, so an unreachable device does not flood the journal.
+func (p *energyPoller) recordHealth(err error) {
+	var prev, next DeviceHealth
+	p.health.Update(func(h DeviceHealth) DeviceHealth {
+		prev = h
+		if err == nil {
+			h.State = DeviceOnline
+			h.LastSuccess = time.Now()
+			h.Failures = 0
+		} else {
+			h.Failures++
+			h.LastError = err.Error()
+			h.LastErrorAt = time.Now()
+			h.State = DeviceDegraded
+			if h.Failures >= offlineAfterFailures {
+				h.State = DeviceOffline
+			}
+		}
+		next = h
+		return h
+	})
+
+	if prev.State == next.State {
+		return
+	}
+	if err != nil {
+		log.Printf("Energy device %s %s: %v", p.device.DeviceID(), next.State, err)
+	} else {
+		log.Printf("Energy device %s online", p.device.DeviceID())
+	}
+}
+
+// nextPoll returns the configured interval, doubled for every failure after
+// the device went offline.
+func (p *energyPoller) nextPoll() time.Duration {
+	interval := time.Duration(p.device.settings().PollIntervalMillis) * time.Millisecond
+	if interval == 0 {
+		interval = 500 * time.Millisecond
+	}
+
+	for i := offlineAfterFailures; i <= p.health.Get().Failures && interval < maxPollBackoff; i++ {
+		interval *= 2
+	}
+	return min(interval, maxPollBackoff)
+}
+
+// healthState returns the state of the device of d. Virtual devices take the
+// worst state of their inputs.
+func (d *EnergySensorState) healthState() DeviceHealthState {
+	if d.health != nil {
+		return d.health.Get().State
+	}
+
+	state := DeviceOnline
+	for _, input := range d.inputs {
+		switch input.healthState() {
+		case DeviceOffline:
+			return DeviceOffline
+		case DeviceDegraded:
+			state = DeviceDegraded
+		}
+	}
+	return state
+}
+
+// serveHealth handles GET /energy/health.
+func (s *EnergyService) serveHealth(w http.ResponseWriter, r *http.Request) {
+	res := map[string]DeviceHealth{}
+	for _, p := range s.pollers {
+		res[p.device.DeviceID()] = p.health.Get()
+	}
+	writeJson(w, res)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fipso/screen-app/tsdb"
+)
+
+// openHistoryStore opens the persistent time-series store. History is only
+// kept in memory if that fails.
+func openHistoryStore() {
+	s, err := tsdb.Open(config.Storage.Path, tsdb.DefaultTiers)
+	if err != nil {
+		log.Println("Could not open history store:", err)
+		return
+	}
+	historyStore = s
+
+	go func() {
+		for range time.Tick(10 * time.Second) {
+			if err := historyStore.Flush(); err != nil {
+				log.Println("Could not flush history store:", err)
+			}
+		}
+	}()
+}
+
+// handleShutdown flushes the history store and saves the energy totals on
+// SIGTERM or SIGINT, so a restart loses no data.
+func handleShutdown() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+
+	log.Println("Shutting down")
+	energyService.accounting.save()
+	if historyStore != nil {
+		if err := historyStore.Close(); err != nil {
+			log.Println("Could not close history store:", err)
+		}
+	}
+	os.Exit(0)
+}
+
+// recordSample appends a value to the history store, if one is open.
+func recordSample(series string, at time.Time, v float64) {
+	if historyStore == nil {
+		return
+	}
+	if err := historyStore.Append(series, at, v); err != nil {
+		log.Println("Could not record sample for", series, err)
+	}
+}
+
+// queryHistory reads a series from the history store, nil if there is none.
+func queryHistory(series string, from, to time.Time, resolution time.Duration) []tsdb.Point {
+	if historyStore == nil {
+		return nil
+	}
+	points, err := historyStore.Query(series, from, to, resolution)
+	if err != nil {
+		log.Println("Could not query history for", series, err)
+		return nil
+	}
+	return points
+}
+
+func accountingPath() string {
+	return filepath.Join(config.Storage.Path, "accounting.json")
+}
+
+// load restores the daily totals saved by save.
+func (a *EnergyAccounting) load() {
+	b, err := os.ReadFile(accountingPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Could not load energy totals:", err)
+			return
+		}
+		a.mu.Lock()
+		a.loaded = true
+		a.mu.Unlock()
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.loaded = true
+	if err := json.Unmarshal(b, &a.days); err != nil {
+		log.Println("Could not load energy totals:", err)
+	}
+}
+
+func (a *EnergyAccounting) save() {
+	a.mu.Lock()
+	if !a.loaded {
+		a.mu.Unlock()
+		return
+	}
+	b, err := json.Marshal(a.days)
+	a.mu.Unlock()
+	if err != nil {
+		log.Println("Could not save energy totals:", err)
+		return
+	}
+
+	if err := writeFileAtomic(accountingPath(), b); err != nil {
+		log.Println("Could not save energy totals:", err)
+	}
+}
+
+// writeFileAtomic writes and renames so a reboot never leaves a half written
+// file.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// HttpService serves the local HTTP API. Other services register their
+// endpoints with HandleFunc, the server only starts if Http.Listen is set.
+type HttpService struct {
+	once sync.Once
+	mux  *http.ServeMux
+}
+
+func (s *HttpService) serveMux() *http.ServeMux {
+	s.once.Do(func() {
+		s.mux = http.NewServeMux()
+	})
+	return s.mux
+}
+
+func (s *HttpService) HandleFunc(pattern string, handler http.HandlerFunc) {
+	s.serveMux().HandleFunc(pattern, handler)
+}
+
+func (s *HttpService) Run() {
+	if config.Http.Listen == "" {
+		return
+	}
+
+	log.Println("HTTP API listening on", config.Http.Listen)
+	if err := http.ListenAndServe(config.Http.Listen, s.serveMux()); err != nil {
+		log.Println("HTTP API stopped:", err)
+	}
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Could not write JSON response:", err)
+	}
+}
@@ -14,7 +14,7 @@ import (
 	"github.com/hajimehoshi/ebiten/v2/text"
 )
 
-var attackRecords KnifeAttackRes
+var attackRecords Observable[KnifeAttackRes]
 
 type KnifeAttackUi struct {
 	screen *ebiten.Image
@@ -93,7 +93,7 @@ func fetchKnifeAttacks() {
 		return
 	}
 
-	attackRecords = data
+	attackRecords.Set(data)
 }
 
 func (ui *KnifeAttackUi) Init() {
@@ -108,11 +108,12 @@ func (ui *KnifeAttackUi) Bounds() (width, height int) {
 func (ui *KnifeAttackUi) Draw() *ebiten.Image {
 	ui.screen.Fill(bgColor)
 
+	records := attackRecords.Get()
 	text.Draw(
 		ui.screen,
 		fmt.Sprintf(
 			" messerinzidenz  %d",
-			len(attackRecords.Items),
+			len(records.Items),
 		),
 		defaultFont,
 		0,
@@ -121,7 +122,7 @@ func (ui *KnifeAttackUi) Draw() *ebiten.Image {
 	)
 
 	height := 0
-	for _, attack := range attackRecords.Items {
+	for _, attack := range records.Items {
 		c := textColor
 		if attack.Wounded {
 			c = color.RGBA{255, 0, 0, 255}
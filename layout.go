@@ -82,3 +82,12 @@ func (l *SwitchLayout) Draw() *ebiten.Image {
 
 	return l.image
 }
+
+func (l *SwitchLayout) Tap(x, y int) {
+	if l.transition {
+		return
+	}
+	if t, ok := l.children[l.currentIndex].(Tappable); ok {
+		t.Tap(x, y)
+	}
+}
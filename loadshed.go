@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LoadShedder keeps the total power under the budget of
+// config.Energy.LoadShedding by switching off low priority devices.
+type LoadShedder struct {
+	cfg LoadSheddingConfig
+
+	mu sync.Mutex
+	// Devices that can be shed, lowest priority first
+	candidates []EnergyDevice
+	// Shed devices in the order they were switched off
+	shed       []shedDevice
+	overSince  time.Time
+	underSince time.Time
+	// busy is set while a plug is switched
+	busy bool
+	// Devices that failed to switch off are skipped until then
+	skipUntil map[EnergyDevice]time.Time
+}
+
+type shedDevice struct {
+	device EnergyDevice
+	offAt  time.Time
+	// Power before it was switched off
+	watts float64
+}
+
+func (l *LoadShedder) Run() {
+	l.cfg = config.Energy.LoadShedding
+	if l.cfg.BudgetWatts == 0 {
+		return
+	}
+	if l.cfg.DelaySeconds == 0 {
+		l.cfg.DelaySeconds = 10
+	}
+	if l.cfg.RestoreSeconds == 0 {
+		l.cfg.RestoreSeconds = 60
+	}
+	if l.cfg.MinOffSeconds == 0 {
+		l.cfg.MinOffSeconds = 300
+	}
+
+	l.skipUntil = map[EnergyDevice]time.Time{}
+	for _, d := range energyDevices() {
+		if d.settings().ShedPriority > 0 {
+			l.candidates = append(l.candidates, d)
+		}
+	}
+	sort.SliceStable(l.candidates, func(i, j int) bool {
+		return l.candidates[i].settings().ShedPriority < l.candidates[j].settings().ShedPriority
+	})
+	l.load()
+
+	derivedValues.On("energy:total", func(total float64) {
+		l.sample(time.Now(), total)
+	})
+}
+
+func (l *LoadShedder) sample(now time.Time, total float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.busy {
+		return
+	}
+
+	switch {
+	case total > l.cfg.BudgetWatts:
+		l.underSince = time.Time{}
+		if l.overSince.IsZero() {
+			l.overSince = now
+		}
+		if now.Sub(l.overSince) < time.Duration(l.cfg.DelaySeconds)*time.Second {
+			return
+		}
+		if d, watts := l.nextToShed(now); d != nil {
+			l.shed = append(l.shed, shedDevice{device: d, offAt: now, watts: watts})
+			// Give the total time to drop before shedding more
+			l.overSince = now
+			l.busy = true
+			go l.switchPlug(d, false, fmt.Sprintf("total %dW over budget", int(total)))
+		}
+
+	case len(l.shed) > 0 && total < l.cfg.BudgetWatts-l.cfg.RestoreMarginWatts:
+		l.overSince = time.Time{}
+		last := l.shed[len(l.shed)-1]
+		if total+last.watts >= l.cfg.BudgetWatts-l.cfg.RestoreMarginWatts ||
+			now.Sub(last.offAt) < time.Duration(l.cfg.MinOffSeconds)*time.Second {
+			l.underSince = time.Time{}
+			return
+		}
+		if l.underSince.IsZero() {
+			l.underSince = now
+		}
+		if now.Sub(l.underSince) < time.Duration(l.cfg.RestoreSeconds)*time.Second {
+			return
+		}
+		l.shed = l.shed[:len(l.shed)-1]
+		l.underSince = time.Time{}
+		l.busy = true
+		go l.switchPlug(last.device, true, "power budget available")
+
+	default:
+		l.overSince = time.Time{}
+		l.underSince = time.Time{}
+	}
+}
+
+// nextToShed returns the lowest priority device that is not shed yet and
+// draws power, with its power.
+func (l *LoadShedder) nextToShed(now time.Time) (EnergyDevice, float64) {
+CANDIDATES:
+	for _, d := range l.candidates {
+		if now.Before(l.skipUntil[d]) {
+			continue
+		}
+		for _, s := range l.shed {
+			if s.device == d {
+				continue CANDIDATES
+			}
+		}
+		// Switching off an idle device frees nothing
+		if watts := energyService.devicePower(d); watts >= 1 {
+			return d, watts
+		}
+	}
+	return nil, 0
+}
+
+// shedOverride holds automations off while their device is shed, the
+// override is cleared when it is restored.
+const shedOverride = 24 * time.Hour
+
+func (l *LoadShedder) switchPlug(d EnergyDevice, on bool, reason string) {
+	name := d.settings().Name
+	var err error
+	if on {
+		err = restoreDevice(d)
+	} else {
+		err = switchDevice(d, false, shedOverride)
+	}
+
+	l.mu.Lock()
+	l.busy = false
+	if err != nil && !on {
+		// Not switched off, try the next device
+		for i, s := range l.shed {
+			if s.device == d {
+				l.shed = append(l.shed[:i], l.shed[i+1:]...)
+				break
+			}
+		}
+		l.skipUntil[d] = time.Now().Add(5 * time.Minute)
+	}
+	shedCount := len(l.shed)
+	l.save()
+	l.mu.Unlock()
+
+	if err != nil {
+		log.Printf("load shedding: %s: %v", name, err)
+		return
+	}
+	log.Printf("load shedding: %s %s, %s", name, onOff(on), reason)
+	derivedValues.Publish("loadshed:count", float64(shedCount))
+	if !on {
+		showAlert(fmt.Sprintf("load shedding\n%s off", name), 20*time.Second)
+	}
+}
+
+// savedShedDevice is a shed device in loadshed.json.
+type savedShedDevice struct {
+	Device string
+	OffAt  time.Time
+	Watts  float64
+}
+
+func loadShedPath() string {
+	return filepath.Join(config.Storage.Path, "loadshed.json")
+}
+
+// load restores the devices shed before a restart, so they are switched
+// back on once the budget allows. Devices switched by an automation are
+// left to it.
+func (l *LoadShedder) load() {
+	b, err := os.ReadFile(loadShedPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Could not load shed devices:", err)
+		}
+		return
+	}
+	var saved []savedShedDevice
+	if err := json.Unmarshal(b, &saved); err != nil {
+		log.Println("Could not load shed devices:", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range saved {
+		for _, d := range l.candidates {
+			if d.DeviceID() != s.Device || automated(d.DeviceID()) {
+				continue
+			}
+			l.shed = append(l.shed, shedDevice{device: d, offAt: s.OffAt, watts: s.Watts})
+			log.Printf("load shedding: %s still shed since %s", d.settings().Name, s.OffAt.Format("15:04"))
+		}
+	}
+}
+
+// automated reports if an automation in the config switches the device.
+// The automation service may not be running yet.
+func automated(id string) bool {
+	for _, cfg := range config.Automations {
+		if cfg.DeviceUUID == id {
+			return true
+		}
+		for _, actions := range [][]AutomationAction{cfg.OnTriggerActions, cfg.OnReleaseActions} {
+			for _, a := range actions {
+				if a.Type == AutomationActionPlug && a.DeviceUUID == id {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// save must be called with l.mu held.
+func (l *LoadShedder) save() {
+	saved := make([]savedShedDevice, 0, len(l.shed))
+	for _, s := range l.shed {
+		saved = append(saved, savedShedDevice{Device: s.device.DeviceID(), OffAt: s.offAt, Watts: s.watts})
+	}
+	b, err := json.Marshal(saved)
+	if err == nil {
+		err = writeFileAtomic(loadShedPath(), b)
+	}
+	if err != nil {
+		log.Println("Could not save shed devices:", err)
+	}
+}
+
+// restoreDevice switches a shed device back on, or hands it back to its
+// automation which decides if it should be on.
+func restoreDevice(d EnergyDevice) error {
+	if automationService != nil {
+		if owner := automationService.owner(d.DeviceID()); owner != "" {
+			return automationService.ClearOverride(owner)
+		}
+	}
+	return d.SetPlugState(true)
+}
@@ -6,15 +6,29 @@ import (
 	"log"
 	"os"
 	"runtime/pprof"
+
+	"github.com/fipso/screen-app/tsdb"
 )
 
 var (
-	game        *Game
-	config      Config
-	mqttService MqttService
+	game              *Game
+	config            Config
+	mqttService       MqttService
+	httpService       HttpService
+	energyService     *EnergyService
+	automationService *AutomationService
+	derivedValues     DerivedValues
+	priceService      PriceService
+	historyStore      *tsdb.Store
 )
 
 func main() {
+	// subcommands
+	if len(os.Args) > 1 && os.Args[1] == "simulate-automations" {
+		runSimulateAutomations(os.Args[2:])
+		return
+	}
+
 	// cli flags
 	cliLayout := flag.String("layout", "", "override config layout from cli")
 	// profiling flags
@@ -48,17 +62,44 @@ func main() {
 	}
 
 	loadConfig()
+	openHistoryStore()
+
+	// Created before any service starts, their goroutines read these
+	game = &Game{}
+	automationService = &AutomationService{}
 
 	mqttService = MqttService{}
 	go mqttService.Run()
 
+	go httpService.Run()
+
 	doorService := DoorService{}
 	go doorService.Run()
 
-	automationService := AutomationService{}
+	go priceService.Run()
+
+	energyService = NewEnergyService(energyDevices(), config.Energy.Virtual)
+	go energyService.Run()
+
+	go runGrowDerivedValues()
+
+	applianceService := &ApplianceService{}
+	go applianceService.Run()
+
+	powerAlertService := &PowerAlertService{}
+	go powerAlertService.Run()
+
+	loadShedder := &LoadShedder{}
+	go loadShedder.Run()
+
+	exportService := &ExportService{}
+	go exportService.Run()
+
 	go automationService.Run()
 
-	go pollBinance()
+	go handleShutdown()
+
+	pollBinance()
 	go pollBusTimes()
 	go pollPollen()
 	go pollWeather()
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/fipso/screen-app/refoss"
+)
+
+// merossMqtt speaks the Meross MQTT protocol over mqttService. Devices
+// listen on /appliance/<uuid>/subscribe, push state changes to
+// /appliance/<uuid>/publish and answer requests on the "from" topic of the
+// request.
+type merossMqtt struct {
+	once  sync.Once
+	topic string
+	ready atomic.Bool
+
+	mu      sync.Mutex
+	pending map[string]chan refoss.Message // message id -> answer
+}
+
+var merossMqttTransport merossMqtt
+
+const (
+	// Requests over MQTT fail after this, leaving time for HTTP
+	merossMqttTimeout = 2 * time.Second
+	// HTTP is used this long after MQTT failed
+	merossMqttRetry = time.Minute
+	// Pushed power is used instead of a request while this fresh
+	merossPushedPowerMaxAge = 5 * time.Second
+)
+
+func (m *merossMqtt) start() {
+	m.once.Do(func() {
+		host, _ := os.Hostname()
+		m.topic = fmt.Sprintf("/app/screen-app-%s/subscribe", host)
+		go func() {
+			mqttService.WaitReady()
+			mqttService.On(m.topic, m.handleAnswer)
+			m.ready.Store(true)
+		}()
+	})
+}
+
+func (m *merossMqtt) From() string {
+	return m.topic
+}
+
+func (m *merossMqtt) RoundTrip(ctx context.Context, msg refoss.Message) (refoss.Message, error) {
+	if !m.ready.Load() {
+		return refoss.Message{}, errors.New("meross mqtt not subscribed yet")
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return refoss.Message{}, err
+	}
+
+	id := msg.Header.MessageID
+	answer := make(chan refoss.Message, 1)
+	m.mu.Lock()
+	if m.pending == nil {
+		m.pending = map[string]chan refoss.Message{}
+	}
+	m.pending[id] = answer
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.pending, id)
+		m.mu.Unlock()
+	}()
+
+	if err := mqttService.Publish("/appliance/"+msg.Header.UUID+"/subscribe", string(body), false); err != nil {
+		return refoss.Message{}, err
+	}
+	select {
+	case a := <-answer:
+		return a, nil
+	case <-ctx.Done():
+		return refoss.Message{}, fmt.Errorf("no mqtt answer from %s: %w", msg.Header.UUID, ctx.Err())
+	}
+}
+
+func (m *merossMqtt) handleAnswer(client mqtt.Client, msg mqtt.Message) {
+	var answer refoss.Message
+	if err := json.Unmarshal(msg.Payload(), &answer); err != nil {
+		log.Println("Could not parse meross answer", msg.Topic(), err)
+		return
+	}
+
+	m.mu.Lock()
+	ch := m.pending[answer.Header.MessageID]
+	m.mu.Unlock()
+	if ch != nil {
+		select {
+		case ch <- answer:
+		default:
+		}
+	}
+}
+
+// merossMqttDevice is a Refoss or Meross device talking over MQTT. It falls
+// back to HTTP while the device does not answer over MQTT.
+type merossMqttDevice struct {
+	*RefossEnergyDeviceConfig
+	pushed pushedPower
+
+	mu        sync.Mutex
+	httpUntil time.Time
+	failing   bool
+}
+
+func (d *merossMqttDevice) start() {
+	merossMqttTransport.start()
+	go func() {
+		mqttService.WaitReady()
+		mqttService.On("/appliance/"+d.UUID+"/publish", d.handlePush)
+	}()
+}
+
+// handlePush takes switch and power changes pushed by the device.
+func (d *merossMqttDevice) handlePush(client mqtt.Client, msg mqtt.Message) {
+	var push refoss.Message
+	if err := json.Unmarshal(msg.Payload(), &push); err != nil {
+		log.Println("Could not parse meross push", msg.Topic(), err)
+		return
+	}
+	if push.Header.Method != "PUSH" {
+		return
+	}
+	c, err := d.client()
+	if err != nil {
+		return
+	}
+
+	namespace := push.Header.Namespace
+	switch namespace {
+	case refoss.NamespaceToggleX:
+		var payload struct {
+			ToggleX json.RawMessage `json:"togglex"`
+		}
+		if err := c.Decode(push, namespace, &payload); err != nil {
+			log.Println("Invalid meross push", msg.Topic(), err)
+			return
+		}
+		for _, t := range jsonOneOrMany[refoss.ToggleX](payload.ToggleX) {
+			if t.Channel == d.SwitchChannel {
+				plugStates.set(d.UUID, t.On())
+			}
+		}
+	case refoss.NamespaceElectricity, refoss.NamespaceElectricityX:
+		var payload struct {
+			Electricity json.RawMessage `json:"electricity"`
+		}
+		if err := c.Decode(push, namespace, &payload); err != nil {
+			log.Println("Invalid meross push", msg.Topic(), err)
+			return
+		}
+		var readings []PowerReading
+		for _, e := range jsonOneOrMany[refoss.Electricity](payload.Electricity) {
+			readings = append(readings, refossReading(e))
+		}
+		d.pushed.set(readings)
+	}
+}
+
+func (d *merossMqttDevice) ReadPower(ctx context.Context, channels []int) ([]PowerReading, error) {
+	// Not all firmwares push power, poll if there is nothing recent
+	if latest, version := d.pushed.latest.Snapshot(); version > 0 && time.Since(latest.at) < merossPushedPowerMaxAge {
+		if res, err := d.pushed.read(channels); err == nil {
+			return res, nil
+		}
+	}
+
+	var res []PowerReading
+	err := d.do(ctx, func(ctx context.Context, c *refoss.Client) error {
+		var err error
+		res, err = readRefossPower(ctx, c, channels)
+		return err
+	})
+	return res, err
+}
+
+func (d *merossMqttDevice) SetPlugState(on bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return d.do(ctx, func(ctx context.Context, c *refoss.Client) error {
+		return d.setPlugState(ctx, c, on)
+	})
+}
+
+func (d *merossMqttDevice) ReadPlugState(ctx context.Context) (bool, error) {
+	var on bool
+	err := d.do(ctx, func(ctx context.Context, c *refoss.Client) error {
+		var err error
+		on, err = d.readPlugState(ctx, c)
+		return err
+	})
+	return on, err
+}
+
+// do runs fn over MQTT, or over HTTP for a while after MQTT failed.
+func (d *merossMqttDevice) do(ctx context.Context, fn func(context.Context, *refoss.Client) error) error {
+	client, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	useMqtt := !time.Now().Before(d.httpUntil)
+	d.mu.Unlock()
+	if useMqtt {
+		mqttCtx, cancel := context.WithTimeout(ctx, merossMqttTimeout)
+		client.Transport = &merossMqttTransport
+		err = fn(mqttCtx, client)
+		cancel()
+
+		d.setFailing(err)
+		if err == nil || d.Address == "" {
+			return err
+		}
+		client.Transport = nil
+	}
+	return fn(ctx, client)
+}
+
+// setFailing records the result of an MQTT request. Only changes are
+// logged, failures switch to HTTP for merossMqttRetry.
+func (d *merossMqttDevice) setFailing(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err == nil {
+		if d.failing {
+			log.Printf("Meross device %s answers over MQTT again", d.UUID)
+		}
+		d.failing = false
+		return
+	}
+	if !d.failing {
+		log.Printf("Meross device %s not answering over MQTT: %v", d.UUID, err)
+	}
+	d.failing = true
+	if d.Address != "" {
+		d.httpUntil = time.Now().Add(merossMqttRetry)
+	}
+}
+
+// jsonOneOrMany decodes an object or an array of objects, Meross payloads
+// use both depending on the firmware.
+func jsonOneOrMany[T any](raw json.RawMessage) []T {
+	var many []T
+	if json.Unmarshal(raw, &many) == nil {
+		return many
+	}
+	var one T
+	if json.Unmarshal(raw, &one) == nil {
+		return []T{one}
+	}
+	return nil
+}
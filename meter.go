@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EnergyDevice is a power meter, optionally with a relay. All kinds of
+// devices share the energy chart, aggregates and automations.
+type EnergyDevice interface {
+	// DeviceID identifies the device in aggregates and plug actions
+	DeviceID() string
+	settings() *EnergyDeviceBase
+	// ReadPower returns the readings of the given channels, or of channel 0
+	// if channels is empty.
+	ReadPower(ctx context.Context, channels []int) ([]PowerReading, error)
+	SetPlugState(on bool) error
+}
+
+// energyDeviceStarter is implemented by devices that need to set something
+// up before they can be read, e.g. subscribe to MQTT topics.
+type energyDeviceStarter interface {
+	start()
+}
+
+// plugStateReader is implemented by devices that can report whether their
+// relay is on.
+type plugStateReader interface {
+	ReadPlugState(ctx context.Context) (bool, error)
+}
+
+type PowerReading struct {
+	Channel int
+	Watts   float64
+	// Zero if the device does not report it
+	Volts  float64
+	Amps   float64
+	Factor float64
+}
+
+func (b *EnergyDeviceBase) settings() *EnergyDeviceBase {
+	return b
+}
+
+var meterHTTPClient = &http.Client{Timeout: 5 * time.Second}
+
+var (
+	energyDevicesOnce sync.Once
+	energyDeviceList  []EnergyDevice
+)
+
+// energyDevices returns all configured energy devices. The list is built
+// once, so push based meters keep their latest readings.
+func energyDevices() []EnergyDevice {
+	energyDevicesOnce.Do(func() {
+		for i := range config.Energy.Devices {
+			d := &config.Energy.Devices[i]
+			if d.Mqtt {
+				energyDeviceList = append(energyDeviceList, &merossMqttDevice{RefossEnergyDeviceConfig: d})
+			} else {
+				energyDeviceList = append(energyDeviceList, d)
+			}
+		}
+		for i := range config.Energy.Shelly {
+			energyDeviceList = append(energyDeviceList, &config.Energy.Shelly[i])
+		}
+		for i := range config.Energy.Tasmota {
+			energyDeviceList = append(energyDeviceList, &tasmotaDevice{TasmotaEnergyDeviceConfig: &config.Energy.Tasmota[i]})
+		}
+		for i := range config.Energy.Mqtt {
+			energyDeviceList = append(energyDeviceList, &mqttEnergyDevice{MqttEnergyDeviceConfig: &config.Energy.Mqtt[i]})
+		}
+	})
+	return energyDeviceList
+}
+
+func findEnergyDevice(id string) EnergyDevice {
+	for _, d := range energyDevices() {
+		if d.DeviceID() == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// pushedPowerMaxAge is how long a pushed reading stays valid. Tasmota sends
+// telemetry every 5 minutes by default.
+const pushedPowerMaxAge = 11 * time.Minute
+
+// pushedPower keeps the latest readings of a push based meter, which are
+// then sampled like a polled device.
+type pushedPower struct {
+	latest Observable[pushedReadings]
+}
+
+type pushedReadings struct {
+	at       time.Time
+	channels map[int]PowerReading
+}
+
+func (p *pushedPower) set(readings []PowerReading) {
+	channels := map[int]PowerReading{}
+	for _, r := range readings {
+		channels[r.Channel] = r
+	}
+	p.latest.Set(pushedReadings{at: time.Now(), channels: channels})
+}
+
+func (p *pushedPower) read(channels []int) ([]PowerReading, error) {
+	latest, version := p.latest.Snapshot()
+	if version == 0 {
+		return nil, errors.New("no reading received yet")
+	}
+	if time.Since(latest.at) > pushedPowerMaxAge {
+		return nil, fmt.Errorf("no reading since %s", latest.at.Format("15:04:05"))
+	}
+
+	if len(channels) == 0 {
+		channels = []int{0}
+	}
+	res := make([]PowerReading, 0, len(channels))
+	for _, ch := range channels {
+		r, ok := latest.channels[ch]
+		if !ok {
+			return nil, fmt.Errorf("no reading for channel %d", ch)
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
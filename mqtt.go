@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -67,3 +68,15 @@ func (s *MqttService) On(topic string, handler mqtt.MessageHandler) {
 		}
 	})
 }
+
+// Publish sends payload to topic and waits until it is delivered to the broker.
+func (s *MqttService) Publish(topic string, payload string, retain bool) error {
+	if s.Client == nil || !s.Client.IsConnected() {
+		return errors.New("mqtt not connected")
+	}
+	token := s.Client.Publish(topic, 0, retain, payload)
+	if !token.WaitTimeout(10 * time.Second) {
+		return errors.New("mqtt publish timed out")
+	}
+	return token.Error()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttEnergyDevice adds the latest received power to the configuration.
+type mqttEnergyDevice struct {
+	*MqttEnergyDeviceConfig
+	pushed pushedPower
+}
+
+func (d *mqttEnergyDevice) DeviceID() string {
+	if d.ID != "" {
+		return d.ID
+	}
+	return d.Name
+}
+
+func (d *mqttEnergyDevice) start() {
+	go func() {
+		mqttService.WaitReady()
+		mqttService.On(d.PowerTopic, func(client mqtt.Client, msg mqtt.Message) {
+			watts, err := d.parsePower(msg.Payload())
+			if err != nil {
+				log.Println("Could not parse MQTT power", msg.Topic(), err)
+				return
+			}
+			d.pushed.set([]PowerReading{{Watts: watts}})
+		})
+	}()
+}
+
+func (d *mqttEnergyDevice) parsePower(payload []byte) (float64, error) {
+	if d.PowerField == "" {
+		return strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	}
+
+	var v any
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return 0, err
+	}
+	for _, key := range strings.Split(d.PowerField, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return 0, fmt.Errorf("field %s not found", d.PowerField)
+		}
+		v = obj[key]
+	}
+	watts, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("field %s is not a number", d.PowerField)
+	}
+	return watts, nil
+}
+
+func (d *mqttEnergyDevice) ReadPower(ctx context.Context, channels []int) ([]PowerReading, error) {
+	return d.pushed.read(channels)
+}
+
+func (d *mqttEnergyDevice) SetPlugState(on bool) error {
+	if d.SwitchTopic == "" {
+		return fmt.Errorf("device %s has no switch topic", d.DeviceID())
+	}
+	payload := d.OffPayload
+	if payload == "" {
+		payload = "OFF"
+	}
+	if on {
+		payload = d.OnPayload
+		if payload == "" {
+			payload = "ON"
+		}
+	}
+	return mqttService.Publish(d.SwitchTopic, payload, false)
+}
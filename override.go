@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Override forces the device of the automation on or off for d by running
+// the plug actions of the matching edge. After that the automation takes
+// over again.
+func (s *AutomationService) Override(name string, on bool, d time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.states[name]
+	if !ok {
+		return fmt.Errorf("automation %s not found", name)
+	}
+
+	now := time.Now()
+	log.Printf("automation %s: manual override %s for %s", name, onOff(on), d)
+	edge := s.override(st, on, d, now)
+
+	// Only the plugs are switched, notifications and webhooks are for
+	// edges of the input
+	actions := st.onRelease
+	if edge {
+		actions = st.onTrigger
+	}
+	var plugs []AutomationAction
+	for _, a := range actions {
+		if a.Type == AutomationActionPlug {
+			plugs = append(plugs, a)
+		}
+	}
+	s.run(st, edge, plugs, now)
+
+	return nil
+}
+
+// OverrideDevice overrides the automation like Override for another service
+// that switches one of its plugs. Only device is switched, synchronously, so
+// the caller gets the error of the relay.
+func (s *AutomationService) OverrideDevice(name string, device EnergyDevice, on bool, d time.Duration) error {
+	s.mu.Lock()
+	st, ok := s.states[name]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("automation %s not found", name)
+	}
+	log.Printf("automation %s: %s switched %s for %s", name, device.settings().Name, onOff(on), d)
+	s.override(st, on, d, time.Now())
+	// Stops retries of earlier edges from switching the plug back
+	st.generation++
+	generation := st.generation
+	s.mu.Unlock()
+
+	err := device.SetPlugState(on)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st.generation == generation {
+		st.lastErr = err
+		if err != nil {
+			st.lastErrAt = time.Now()
+		}
+	}
+	return err
+}
+
+// override records the override and returns the condition edge matching on.
+// Must be called with s.mu held.
+func (s *AutomationService) override(st *automationState, on bool, d time.Duration, now time.Time) bool {
+	s.cancelPending(st)
+	st.overrideOn = on
+	st.overrideUntil = now.Add(d)
+
+	// The actions run even if the automation believes the device is in
+	// that state already, the relay may have been switched elsewhere.
+	edge := on == st.onState
+	if st.haveApplied && st.applied != edge {
+		st.toggles = append(st.toggles, now)
+	}
+	st.applied = edge
+	st.haveApplied = true
+	st.lastSwitch = now
+	return edge
+}
+
+// switchDevice switches a plug for another service. If an automation
+// switches the plug, this overrides the automation for d so it does not
+// switch the plug right back and knows its state.
+func switchDevice(device EnergyDevice, on bool, d time.Duration) error {
+	if automationService != nil {
+		if owner := automationService.owner(device.DeviceID()); owner != "" {
+			if d == 0 {
+				d = automationService.overrideStep(owner)
+			}
+			return automationService.OverrideDevice(owner, device, on, d)
+		}
+	}
+	return device.SetPlugState(on)
+}
+
+// ClearOverride hands control back to the automation immediately.
+func (s *AutomationService) ClearOverride(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.states[name]
+	if !ok {
+		return fmt.Errorf("automation %s not found", name)
+	}
+	if !st.overrideUntil.IsZero() {
+		s.endOverride(st, time.Now())
+	}
+	return nil
+}
+
+// endOverride must be called with s.mu held.
+func (s *AutomationService) endOverride(st *automationState, now time.Time) {
+	log.Printf("automation %s: manual override ended", st.cfg.Name)
+	st.overrideUntil = time.Time{}
+	if st.haveValue {
+		s.apply(st, now)
+	}
+}
+
+// handleOverrideCommand parses "on [duration]", "off [duration]" or "auto".
+func (s *AutomationService) handleOverrideCommand(name, cmd string) error {
+	fields := strings.Fields(strings.ToLower(cmd))
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("invalid override command %q", cmd)
+	}
+
+	d := time.Duration(0)
+	if len(fields) == 2 {
+		var err error
+		d, err = time.ParseDuration(fields[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	switch fields[0] {
+	case "auto":
+		return s.ClearOverride(name)
+	case "on", "off":
+		if d == 0 {
+			d = s.overrideStep(name)
+		}
+		return s.Override(name, fields[0] == "on", d)
+	}
+	return fmt.Errorf("invalid override command %q", cmd)
+}
+
+func (s *AutomationService) overrideStep(name string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.states[name]; ok {
+		return time.Duration(st.cfg.OverrideMinutes) * time.Minute
+	}
+	return time.Hour
+}
+
+type automationStatus struct {
+	Name          string
+	Value         float64
+	HaveValue     bool
+	Triggered     bool
+	On            bool
+	LastSwitch    time.Time
+	Devices       []string
+	Stale         bool
+	OverrideOn    bool
+	OverrideUntil time.Time
+	LastError     string
+}
+
+func (s *AutomationService) status() []automationStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	res := make([]automationStatus, 0, len(s.list))
+	for _, st := range s.list {
+		status := automationStatus{
+			Name:       st.cfg.Name,
+			Value:      st.lastValue,
+			HaveValue:  st.haveValue,
+			Triggered:  st.triggered,
+			On:         st.haveApplied && st.applied == st.onState,
+			LastSwitch: st.lastSwitch,
+			Devices:    st.deviceNames(),
+			Stale:      st.stale,
+		}
+		if now.Before(st.overrideUntil) {
+			status.OverrideOn = st.overrideOn
+			status.OverrideUntil = st.overrideUntil
+		}
+		if st.lastErr != nil {
+			status.LastError = st.lastErr.Error()
+		}
+		res = append(res, status)
+	}
+
+	return res
+}
+
+// deviceNames lists the plugs switched by the automation.
+func (st *automationState) deviceNames() []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, actions := range [][]AutomationAction{st.onTrigger, st.onRelease} {
+		for _, a := range actions {
+			if a.Type != AutomationActionPlug || seen[a.DeviceUUID] {
+				continue
+			}
+			seen[a.DeviceUUID] = true
+			name := a.DeviceUUID
+			if device := findEnergyDevice(a.DeviceUUID); device != nil {
+				name = device.settings().Name
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// serveStatus handles GET /automations.
+func (s *AutomationService) serveStatus(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, s.status())
+}
+
+// serveOverride handles POST /automations/<name>/override?state=on|off|auto&duration=30m.
+func (s *AutomationService) serveOverride(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/automations/"), "/override")
+	if !ok || name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	cmd := strings.TrimSpace(r.URL.Query().Get("state") + " " + r.URL.Query().Get("duration"))
+	if err := s.handleOverrideCommand(name, cmd); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/text"
+	"github.com/hajimehoshi/ebiten/v2/vector"
+)
+
+// PlugStates holds the last known relay state per device ID. It is written
+// by the plug widget's polling and by every successful switch.
+type PlugStates struct {
+	states Observable[map[string]bool]
+}
+
+var plugStates PlugStates
+
+func (p *PlugStates) set(id string, on bool) {
+	p.states.Update(func(old map[string]bool) map[string]bool {
+		if v, ok := old[id]; ok && v == on {
+			return old
+		}
+		states := make(map[string]bool, len(old)+1)
+		for k, v := range old {
+			states[k] = v
+		}
+		states[id] = on
+		return states
+	})
+}
+
+func (p *PlugStates) get(id string) (on, ok bool) {
+	on, ok = p.states.Get()[id]
+	return
+}
+
+// owners lists the automations that switch the device, marking the ones
+// with an active manual override.
+func (s *AutomationService) owners(id string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var names []string
+	for _, st := range s.list {
+		if !st.switchesDevice(id) {
+			continue
+		}
+		name := strings.ToLower(st.cfg.Name)
+		if now.Before(st.overrideUntil) {
+			name += " (manual)"
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// owner returns the first automation that switches the device.
+func (s *AutomationService) owner(id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.list {
+		if st.switchesDevice(id) {
+			return st.cfg.Name
+		}
+	}
+	return ""
+}
+
+func (st *automationState) switchesDevice(id string) bool {
+	for _, actions := range [][]AutomationAction{st.onTrigger, st.onRelease} {
+		for _, a := range actions {
+			if a.Type == AutomationActionPlug && a.DeviceUUID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PlugUi shows a tile per switchable plug with its state, power and the
+// automation controlling it. Tapping a tile toggles the plug.
+type PlugUi struct {
+	screen *ebiten.Image
+	plugs  []EnergyDevice
+
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+const (
+	plugTileHeight  = 220
+	plugTileColumns = 2
+	plugTilePadding = 10
+	// Other switches (apps, buttons on the plug) show up after this
+	plugPollInterval = 2 * time.Second
+)
+
+func (ui *PlugUi) Init() {
+	for _, d := range energyDevices() {
+		if _, ok := d.(plugStateReader); ok {
+			ui.plugs = append(ui.plugs, d)
+		}
+	}
+	ui.busy = map[string]bool{}
+
+	width, height := ui.Bounds()
+	ui.screen = ebiten.NewImage(width, height)
+
+	for _, d := range ui.plugs {
+		go ui.poll(d)
+	}
+}
+
+func (ui *PlugUi) Bounds() (width, height int) {
+	rows := (len(ui.plugs) + plugTileColumns - 1) / plugTileColumns
+	return config.Width, max(rows, 1) * plugTileHeight
+}
+
+func (ui *PlugUi) poll(d EnergyDevice) {
+	reader := d.(plugStateReader)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		on, err := reader.ReadPlugState(ctx)
+		cancel()
+		if err == nil {
+			plugStates.set(d.DeviceID(), on)
+		}
+		time.Sleep(plugPollInterval)
+	}
+}
+
+func (ui *PlugUi) tileRect(i int) (x, y, w, h int) {
+	w = config.Width / plugTileColumns
+	return (i%plugTileColumns)*w + plugTilePadding, (i/plugTileColumns)*plugTileHeight + plugTilePadding,
+		w - plugTilePadding*2, plugTileHeight - plugTilePadding*2
+}
+
+func (ui *PlugUi) Draw() *ebiten.Image {
+	ui.screen.Fill(bgColor)
+
+	for i, d := range ui.plugs {
+		x, y, w, h := ui.tileRect(i)
+		id := d.DeviceID()
+		on, known := plugStates.get(id)
+
+		fg := textColor
+		if known && on {
+			vector.DrawFilledRect(ui.screen, float32(x), float32(y), float32(w), float32(h), textColor, false)
+			fg = bgColor
+		} else {
+			vector.StrokeRect(ui.screen, float32(x), float32(y), float32(w), float32(h), 2, textColor, false)
+		}
+
+		state := "?"
+		if known {
+			state = onOff(on)
+		}
+		ui.mu.Lock()
+		if ui.busy[id] {
+			state = "..."
+		}
+		ui.mu.Unlock()
+
+		text.Draw(ui.screen, strings.ToLower(d.settings().Name), smallFont, x+15, y+55, fg)
+		text.Draw(
+			ui.screen,
+			fmt.Sprintf("%s  %dW", state, int(energyService.devicePower(d))),
+			defaultFont,
+			x+15,
+			y+135,
+			fg,
+		)
+		if automationService != nil {
+			if owners := automationService.owners(id); len(owners) > 0 {
+				text.Draw(ui.screen, strings.Join(owners, ", "), tinyFont, x+15, y+185, fg)
+			}
+		}
+	}
+
+	return ui.screen
+}
+
+// Tap toggles the plug. If an automation switches it, the toggle is a
+// manual override so the automation does not switch it right back.
+func (ui *PlugUi) Tap(x, y int) {
+	for i, d := range ui.plugs {
+		tx, ty, w, h := ui.tileRect(i)
+		if x < tx || x >= tx+w || y < ty || y >= ty+h {
+			continue
+		}
+
+		id := d.DeviceID()
+		ui.mu.Lock()
+		if ui.busy[id] {
+			ui.mu.Unlock()
+			return
+		}
+		ui.busy[id] = true
+		ui.mu.Unlock()
+
+		on, _ := plugStates.get(id)
+		go ui.toggle(d, !on)
+		return
+	}
+}
+
+func (ui *PlugUi) toggle(d EnergyDevice, on bool) {
+	id := d.DeviceID()
+	defer func() {
+		ui.mu.Lock()
+		delete(ui.busy, id)
+		ui.mu.Unlock()
+	}()
+
+	var owner string
+	if automationService != nil {
+		owner = automationService.owner(id)
+	}
+	if owner != "" {
+		if err := automationService.Override(owner, on, automationService.overrideStep(owner)); err != nil {
+			log.Printf("plugs: override %s: %v", owner, err)
+		}
+		return
+	}
+	if err := d.SetPlugState(on); err != nil {
+		log.Println("plugs:", err)
+	}
+}
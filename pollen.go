@@ -78,11 +78,9 @@ type PollenData struct {
 	LastUpdate string `json:"last_update"`
 }
 
-var pollenStrength map[string]string
+var pollenStrength Observable[map[string]string]
 
 func pollPollen() {
-	pollenStrength = make(map[string]string)
-
 	for {
 		fetchPollen()
 		time.Sleep(10 * time.Minute)
@@ -113,9 +111,11 @@ func fetchPollen() error {
 		}
 	}
 
-	pollenStrength["g"] = entry.Pollen.Graeser.Today
-	pollenStrength["b"] = entry.Pollen.Birke.Today
-	pollenStrength["h"] = entry.Pollen.Hasel.Today
+	pollenStrength.Set(map[string]string{
+		"g": entry.Pollen.Graeser.Today,
+		"b": entry.Pollen.Birke.Today,
+		"h": entry.Pollen.Hasel.Today,
+	})
 
 	return nil
 }
@@ -135,7 +135,7 @@ func fetchPollen() error {
 // 	pollenS := "pollen: "
 // 	pollenKeys := []string{"g", "b", "h"}
 // 	for _, key := range pollenKeys {
-// 		v := pollenStrength[key]
+// 		v := pollenStrength.Get()[key]
 // 		pollenS += fmt.Sprintf("%s%s ", key, v)
 // 	}
 // 	text.Draw(ui.screen, pollenS, defaultFont, 0, fontHeight, textColor)
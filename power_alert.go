@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PowerAlertService watches the power of devices and the total for
+// overloads and unexpected consumption.
+type PowerAlertService struct{}
+
+type powerAlert struct {
+	cfg PowerAlertConfig
+
+	mu sync.Mutex
+	// since is when the condition became true, zero while it is false
+	since    time.Time
+	active   bool
+	notified time.Time
+}
+
+// powerAlertEvent is published to screen-app/alert/<name>.
+type powerAlertEvent struct {
+	Active bool      `json:"active"`
+	Watts  float64   `json:"watts"`
+	Since  time.Time `json:"since"`
+}
+
+func (s *PowerAlertService) Run() {
+	for _, cfg := range config.Energy.Alerts {
+		a := &powerAlert{cfg: cfg}
+
+		input := "energy:total"
+		if cfg.Device != "" {
+			d := energyService.device(cfg.Device)
+			if d == nil {
+				d = energyService.deviceByName(cfg.Device)
+			}
+			if d == nil {
+				log.Printf("power alert %s: device %s not found", cfg.Name, cfg.Device)
+				continue
+			}
+			input = "energy:" + d.name
+		}
+		derivedValues.On(input, func(watts float64) {
+			a.sample(time.Now(), watts)
+		})
+	}
+}
+
+func (a *powerAlert) sample(now time.Time, watts float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	limit := a.cfg.AboveWatts
+	if a.active {
+		limit -= a.cfg.Hysteresis
+	}
+	if watts <= limit || !a.inWindow(now) {
+		a.since = time.Time{}
+		if a.active {
+			a.active = false
+			go a.publish(powerAlertEvent{Active: false, Watts: watts})
+		}
+		return
+	}
+
+	if a.since.IsZero() {
+		a.since = now
+	}
+	if now.Sub(a.since) < time.Duration(a.cfg.Minutes)*time.Minute {
+		return
+	}
+
+	repeat := time.Duration(a.cfg.RepeatMinutes) * time.Minute
+	if a.active && (repeat == 0 || now.Sub(a.notified) < repeat) {
+		return
+	}
+	first := !a.active
+	a.active = true
+	a.notified = now
+	go a.fire(powerAlertEvent{Active: true, Watts: watts, Since: a.since}, first)
+}
+
+func (a *powerAlert) inWindow(now time.Time) bool {
+	if len(a.cfg.Windows) == 0 {
+		return true
+	}
+	for _, w := range a.cfg.Windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// fire shows the alert and publishes it. Devices are only switched off the
+// first time, so a manual switch-on is not fought.
+func (a *powerAlert) fire(e powerAlertEvent, first bool) {
+	log.Printf("power alert %s: %.0fW since %s", a.cfg.Name, e.Watts, e.Since.Format("15:04"))
+
+	msg := fmt.Sprintf("%s\n%dW since %s", a.cfg.Name, int(e.Watts), e.Since.Format("15:04"))
+	if first {
+		for _, id := range a.cfg.SwitchOff {
+			device := findEnergyDevice(id)
+			if device == nil {
+				log.Printf("power alert %s: device %s not found", a.cfg.Name, id)
+				continue
+			}
+			name := device.settings().Name
+			if err := switchDevice(device, false, 0); err != nil {
+				log.Printf("power alert %s: %v", a.cfg.Name, err)
+				msg += "\n" + name + " switch off failed"
+				continue
+			}
+			msg += "\n" + name + " switched off"
+		}
+	}
+
+	showAlert(strings.ToLower(msg), time.Minute)
+	a.publish(e)
+}
+
+func (a *powerAlert) publish(e powerAlertEvent) {
+	v := 0.0
+	if e.Active {
+		v = 1
+	}
+	derivedValues.Publish("alert:"+a.cfg.Name, v)
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Println("Could not encode power alert:", err)
+		return
+	}
+	topic := fmt.Sprintf("screen-app/alert/%s", a.cfg.Name)
+	if err := mqttService.Publish(topic, string(b), true); err != nil {
+		log.Printf("power alert %s: could not publish: %v", a.cfg.Name, err)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/text"
+	"github.com/hajimehoshi/ebiten/v2/vector"
+)
+
+// PricePoint is the price of one slot of a dynamic tariff, usually an hour.
+type PricePoint struct {
+	Start       time.Time
+	End         time.Time
+	PricePerKWh float64
+}
+
+// PriceService loads the hourly prices of a dynamic tariff.
+type PriceService struct {
+	// Sorted by start, the last two days are kept
+	prices Observable[[]PricePoint]
+}
+
+// priceSource loads prices from a feed or file.
+type priceSource interface {
+	fetchPrices() ([]PricePoint, error)
+}
+
+func newPriceSource(cfg DynamicPriceConfig) priceSource {
+	switch {
+	case cfg.File != "":
+		return filePriceSource{path: cfg.File}
+	case cfg.URL != "":
+		return httpPriceSource{url: cfg.URL}
+	}
+	return nil
+}
+
+func (s *PriceService) Run() {
+	cfg := config.Energy.Tariff.Dynamic
+	source := newPriceSource(cfg)
+	if source == nil {
+		return
+	}
+	httpService.HandleFunc("/energy/prices", s.servePrices)
+
+	refresh := time.Duration(cfg.RefreshMinutes) * time.Minute
+	nextFetch := time.Now()
+	for {
+		now := time.Now()
+		if !now.Before(nextFetch) {
+			nextFetch = now.Add(refresh)
+			prices, err := source.fetchPrices()
+			if err != nil {
+				log.Println("Error fetching electricity prices:", err)
+				nextFetch = now.Add(5 * time.Minute)
+			} else {
+				s.merge(prices, now)
+			}
+		}
+
+		if p, ok := s.at(now); ok {
+			derivedValues.Publish("price:current", p)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// merge adds fetched prices, replacing known slots with the same start and
+// dropping slots older than two days.
+func (s *PriceService) merge(prices []PricePoint, now time.Time) {
+	s.prices.Update(func(old []PricePoint) []PricePoint {
+		byStart := map[int64]PricePoint{}
+		for _, p := range old {
+			byStart[p.Start.Unix()] = p
+		}
+		for _, p := range prices {
+			byStart[p.Start.Unix()] = p
+		}
+
+		res := make([]PricePoint, 0, len(byStart))
+		for _, p := range byStart {
+			if now.Sub(p.End) < 48*time.Hour {
+				res = append(res, p)
+			}
+		}
+		sort.Slice(res, func(i, j int) bool {
+			return res[i].Start.Before(res[j].Start)
+		})
+		return res
+	})
+}
+
+// at returns the price per kWh at t if it is known.
+func (s *PriceService) at(t time.Time) (float64, bool) {
+	prices := s.prices.Get()
+	i := sort.Search(len(prices), func(i int) bool {
+		return prices[i].End.After(t)
+	})
+	if i < len(prices) && !prices[i].Start.After(t) {
+		return prices[i].PricePerKWh, true
+	}
+	return 0, false
+}
+
+// servePrices handles GET /energy/prices.
+func (s *PriceService) servePrices(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, map[string]any{
+		"currency": config.Energy.Tariff.Currency,
+		"prices":   s.prices.Get(),
+	})
+}
+
+type awattarResponse struct {
+	Data []struct {
+		StartTimestamp int64   `json:"start_timestamp"`
+		EndTimestamp   int64   `json:"end_timestamp"`
+		MarketPrice    float64 `json:"marketprice"`
+		Unit           string  `json:"unit"`
+	} `json:"data"`
+}
+
+// parseAwattar converts the market prices, usually in €/MWh, into prices
+// per kWh.
+func parseAwattar(r io.Reader, cfg DynamicPriceConfig) ([]PricePoint, error) {
+	var res awattarResponse
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, err
+	}
+
+	prices := make([]PricePoint, 0, len(res.Data))
+	for _, d := range res.Data {
+		price := d.MarketPrice
+		if !strings.HasSuffix(strings.ToLower(d.Unit), "/kwh") {
+			price /= 1000
+		}
+		prices = append(prices, PricePoint{
+			Start:       time.UnixMilli(d.StartTimestamp),
+			End:         time.UnixMilli(d.EndTimestamp),
+			PricePerKWh: price*cfg.Factor + cfg.Surcharge,
+		})
+	}
+	return prices, nil
+}
+
+type httpPriceSource struct {
+	url string
+}
+
+func (s httpPriceSource) fetchPrices() ([]PricePoint, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("price feed returned %s", resp.Status)
+	}
+	return parseAwattar(resp.Body, config.Energy.Tariff.Dynamic)
+}
+
+type filePriceSource struct {
+	path string
+}
+
+func (s filePriceSource) fetchPrices() ([]PricePoint, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseAwattar(f, config.Energy.Tariff.Dynamic)
+}
+
+// PriceUi shows the known hourly prices from today on as bars. The current
+// hour is highlighted, hours below the average are green.
+type PriceUi struct {
+	screen *ebiten.Image
+}
+
+const priceChartHeight = 400
+
+func (ui *PriceUi) Init() {
+	width, height := ui.Bounds()
+	ui.screen = ebiten.NewImage(width, height)
+}
+
+func (ui *PriceUi) Bounds() (width, height int) {
+	return config.Width, fontHeight + linePadding*2 + priceChartHeight + 50
+}
+
+func (ui *PriceUi) Draw() *ebiten.Image {
+	ui.screen.Fill(bgColor)
+
+	now := time.Now()
+	var prices []PricePoint
+	for _, p := range priceService.prices.Get() {
+		if p.End.After(startOfDay(now)) {
+			prices = append(prices, p)
+		}
+	}
+
+	currency := config.Energy.Tariff.Currency
+	header := "prices"
+	if p, ok := priceService.at(now); ok {
+		header = fmt.Sprintf("prices  now %.3f%s/kwh", p, currency)
+	}
+	text.Draw(ui.screen, header, defaultFont, 0, fontHeight, textColor)
+	if len(prices) == 0 {
+		return ui.screen
+	}
+
+	low, high, sum := 0.0, 0.0, 0.0
+	for _, p := range prices {
+		low = min(low, p.PricePerKWh)
+		high = max(high, p.PricePerKWh)
+		sum += p.PricePerKWh
+	}
+	avg := sum / float64(len(prices))
+	if high == low {
+		high = low + 1
+	}
+
+	top := float32(fontHeight + linePadding*2)
+	scale := float32(priceChartHeight) / float32(high-low)
+	zero := top + float32(high)*scale
+	barWidth := float32(config.Width) / float32(len(prices))
+
+	for i, p := range prices {
+		c := color.RGBA{128, 128, 128, 255}
+		if p.PricePerKWh < avg {
+			c = color.RGBA{20, 200, 20, 255}
+		}
+		if !now.Before(p.Start) && now.Before(p.End) {
+			c = textColor
+		}
+
+		x := float32(i) * barWidth
+		y := zero - float32(p.PricePerKWh)*scale
+		vector.DrawFilledRect(ui.screen, x+1, min(y, zero), max(barWidth-2, 1), abs32(zero-y), c, false)
+
+		if p.Start.Hour()%6 == 0 {
+			text.Draw(ui.screen, p.Start.Format("15"), tinyFont, int(x), int(top)+priceChartHeight+40, textColor)
+		}
+	}
+
+	text.Draw(ui.screen, fmt.Sprintf("%.3f", high), tinyFont, config.Width-100, int(top)+30, textColor)
+
+	return ui.screen
+}
+
+func abs32(v float32) float32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,341 @@
+// Package refoss implements the local API of Refoss and Meross smart plugs
+// and energy monitors. Messages go over HTTP unless a client has a
+// Transport, e.g. for MQTT.
+package refoss
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	NamespaceElectricity = "Appliance.Control.Electricity"
+	// Multi channel energy monitors like the EM06
+	NamespaceElectricityX = "Appliance.Control.ElectricityX"
+	NamespaceToggleX      = "Appliance.Control.ToggleX"
+	NamespaceSystemAll    = "Appliance.System.All"
+	NamespaceConsumption  = "Appliance.Control.ConsumptionX"
+)
+
+// DefaultHTTPClient is used by clients without their own HTTPClient.
+var DefaultHTTPClient = &http.Client{Timeout: 5 * time.Second}
+
+type Client struct {
+	// Address is the base URL of the device, e.g. http://192.168.1.20
+	Address string
+	UUID    string
+	// Key is the profile key used for signing messages
+	Key        string
+	HTTPClient *http.Client
+	// Transport replaces HTTP if set
+	Transport Transport
+}
+
+// Transport delivers a signed message to the device and returns its answer.
+type Transport interface {
+	// From is the sender address of requests, the device answers to it
+	From() string
+	RoundTrip(ctx context.Context, msg Message) (Message, error)
+}
+
+func NewClient(address, uuid, key string) *Client {
+	return &Client{
+		Address: address,
+		UUID:    uuid,
+		Key:     key,
+	}
+}
+
+type Header struct {
+	MessageID      string `json:"messageId"`
+	Method         string `json:"method"`
+	From           string `json:"from"`
+	PayloadVersion int    `json:"payloadVersion"`
+	Namespace      string `json:"namespace"`
+	UUID           string `json:"uuid,omitempty"`
+	Sign           string `json:"sign"`
+	TriggerSrc     string `json:"triggerSrc,omitempty"`
+	Timestamp      int64  `json:"timestamp"`
+}
+
+type Message struct {
+	Header  Header          `json:"header"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Electricity is the current reading of one channel.
+type Electricity struct {
+	Channel int `json:"channel"`
+	// mA
+	Current int `json:"current"`
+	// dV
+	Voltage int `json:"voltage"`
+	// mW
+	Power int `json:"power"`
+	// Power factor, not reported by all firmwares
+	Factor float64 `json:"factor,omitempty"`
+	Config struct {
+		VoltageRatio          int `json:"voltageRatio"`
+		ElectricityRatio      int `json:"electricityRatio"`
+		MaxElectricityCurrent int `json:"maxElectricityCurrent"`
+		PowerRatio            int `json:"powerRatio"`
+	} `json:"config"`
+}
+
+func (e Electricity) Watts() float64 {
+	return float64(e.Power) / 1000
+}
+
+func (e Electricity) Volts() float64 {
+	return float64(e.Voltage) / 10
+}
+
+func (e Electricity) Amps() float64 {
+	return float64(e.Current) / 1000
+}
+
+type ToggleX struct {
+	Channel int   `json:"channel"`
+	Onoff   int   `json:"onoff"`
+	LmTime  int64 `json:"lmTime,omitempty"`
+}
+
+func (t ToggleX) On() bool {
+	return t.Onoff == 1
+}
+
+type SystemAll struct {
+	All struct {
+		System struct {
+			Hardware struct {
+				Type       string `json:"type"`
+				SubType    string `json:"subType"`
+				Version    string `json:"version"`
+				UUID       string `json:"uuid"`
+				MacAddress string `json:"macAddress"`
+			} `json:"hardware"`
+			Firmware struct {
+				Version string `json:"version"`
+				InnerIP string `json:"innerIp"`
+			} `json:"firmware"`
+			Time struct {
+				Timestamp int64  `json:"timestamp"`
+				Timezone  string `json:"timezone"`
+			} `json:"time"`
+			Online struct {
+				Status int `json:"status"`
+			} `json:"online"`
+		} `json:"system"`
+		Digest struct {
+			ToggleX []ToggleX `json:"togglex"`
+		} `json:"digest"`
+	} `json:"all"`
+}
+
+// Consumption is the energy used on one day.
+type Consumption struct {
+	Date string `json:"date"`
+	// Unix timestamp of the last update
+	Time int64 `json:"time"`
+	// Wh
+	Value int `json:"value"`
+}
+
+// Electricity reads the power, voltage and current of a channel.
+func (c *Client) Electricity(ctx context.Context, channel int) (Electricity, error) {
+	var res struct {
+		Electricity Electricity `json:"electricity"`
+	}
+	req := map[string]any{"electricity": map[string]int{"channel": channel}}
+	err := c.Do(ctx, "GET", NamespaceElectricity, req, &res)
+	return res.Electricity, err
+}
+
+// ElectricityX reads several channels of a multi channel energy monitor with
+// a single request.
+func (c *Client) ElectricityX(ctx context.Context, channels []int) ([]Electricity, error) {
+	type channel struct {
+		Channel int `json:"channel"`
+	}
+	reqChannels := make([]channel, len(channels))
+	for i, ch := range channels {
+		reqChannels[i] = channel{Channel: ch}
+	}
+
+	var res struct {
+		Electricity []Electricity `json:"electricity"`
+	}
+	req := map[string]any{"electricity": reqChannels}
+	err := c.Do(ctx, "GET", NamespaceElectricityX, req, &res)
+	return res.Electricity, err
+}
+
+// ToggleX switches a channel on or off.
+func (c *Client) ToggleX(ctx context.Context, channel int, on bool) error {
+	onoff := 0
+	if on {
+		onoff = 1
+	}
+	req := map[string]any{"togglex": ToggleX{Channel: channel, Onoff: onoff}}
+	return c.Do(ctx, "SET", NamespaceToggleX, req, nil)
+}
+
+// SystemAll reads hardware, firmware and the on/off state of all channels.
+func (c *Client) SystemAll(ctx context.Context) (SystemAll, error) {
+	var res SystemAll
+	err := c.Do(ctx, "GET", NamespaceSystemAll, map[string]any{}, &res)
+	return res, err
+}
+
+// Consumption reads the daily energy history kept by the device.
+func (c *Client) Consumption(ctx context.Context) ([]Consumption, error) {
+	var res struct {
+		ConsumptionX []Consumption `json:"consumptionx"`
+	}
+	err := c.Do(ctx, "GET", NamespaceConsumption, map[string]any{}, &res)
+	return res.ConsumptionX, err
+}
+
+// Do sends a signed request and decodes the payload of the answer into res,
+// which may be nil.
+func (c *Client) Do(ctx context.Context, method, namespace string, payload any, res any) error {
+	if c.Transport != nil {
+		msg, err := c.NewMessage(method, namespace, c.Transport.From(), payload)
+		if err != nil {
+			return err
+		}
+		answer, err := c.Transport.RoundTrip(ctx, msg)
+		if err != nil {
+			return err
+		}
+		return c.Decode(answer, namespace, res)
+	}
+
+	url := c.Address + "/config"
+	msg, err := c.NewMessage(method, namespace, url, payload)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "keep-alive")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("User-Agent", "intellect_socket/1.10.0 (iPhone; iOS 18.3.2; Scale/3.00)")
+	req.Header.Set("Accept-Language", "en-DE;q=1, de-DE;q=0.9")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = DefaultHTTPClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &HTTPError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	var answer Message
+	if err := json.Unmarshal(respBody, &answer); err != nil {
+		return fmt.Errorf("refoss: invalid response: %w", err)
+	}
+
+	return c.Decode(answer, namespace, res)
+}
+
+// NewMessage builds a signed message. url is used as the sender address.
+func (c *Client) NewMessage(method, namespace, url string, payload any) (Message, error) {
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+
+	messageID := GenerateMessageID()
+	timestamp := time.Now().Unix()
+	return Message{
+		Header: Header{
+			MessageID:      messageID,
+			Method:         method,
+			From:           url,
+			PayloadVersion: 1,
+			Namespace:      namespace,
+			UUID:           c.UUID,
+			Sign:           Sign(messageID, c.Key, timestamp),
+			TriggerSrc:     "GoClient",
+			Timestamp:      timestamp,
+		},
+		Payload: p,
+	}, nil
+}
+
+// Decode checks signature and error state of an answer to a namespace
+// request and unmarshals its payload into res, which may be nil.
+func (c *Client) Decode(answer Message, namespace string, res any) error {
+	if answer.Header.Sign != Sign(answer.Header.MessageID, c.Key, answer.Header.Timestamp) {
+		return ErrInvalidSignature
+	}
+
+	if answer.Header.Method == "ERROR" {
+		var p struct {
+			Error struct {
+				Code   int    `json:"code"`
+				Detail string `json:"detail"`
+			} `json:"error"`
+		}
+		json.Unmarshal(answer.Payload, &p)
+		return &DeviceError{Namespace: namespace, Code: p.Error.Code, Detail: p.Error.Detail}
+	}
+	if answer.Header.Namespace != namespace {
+		return fmt.Errorf("refoss: answer for namespace %s, expected %s", answer.Header.Namespace, namespace)
+	}
+
+	if res == nil {
+		return nil
+	}
+	if err := json.Unmarshal(answer.Payload, res); err != nil {
+		return fmt.Errorf("refoss: invalid %s payload: %w", namespace, err)
+	}
+	return nil
+}
+
+// Sign calculates the message signature md5(messageId + key + timestamp).
+func Sign(messageID, key string, timestamp int64) string {
+	return md5Hash(messageID + key + strconv.FormatInt(timestamp, 10))
+}
+
+// GenerateMessageID returns md5 of 16 random chars and the current unix time,
+// like the vendor app.
+func GenerateMessageID() string {
+	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	random := make([]byte, 16)
+	for i := range random {
+		random[i] = charset[rand.Intn(len(charset))]
+	}
+	return md5Hash(string(random) + strconv.FormatInt(time.Now().Unix(), 10))
+}
+
+func md5Hash(input string) string {
+	hash := md5.Sum([]byte(input))
+	return fmt.Sprintf("%x", hash)
+}
@@ -0,0 +1,133 @@
+package refoss_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fipso/screen-app/refoss"
+	"github.com/fipso/screen-app/refoss/refosstest"
+)
+
+func TestSignature(t *testing.T) {
+	d := refosstest.NewDevice("uuid", "key")
+	defer d.Close()
+
+	if _, err := d.Client().Electricity(context.Background(), 0); err != nil {
+		t.Fatalf("signed request failed: %v", err)
+	}
+
+	// The device rejects the request and its answer does not verify with
+	// the wrong key either
+	c := d.Client()
+	c.Key = "wrong"
+	_, err := c.Electricity(context.Background(), 0)
+	if !errors.Is(err, refoss.ErrInvalidSignature) {
+		t.Fatalf("got %v, want ErrInvalidSignature", err)
+	}
+
+	reqs := d.Requests()
+	if got := reqs[len(reqs)-1].Header; got.Sign != refoss.Sign(got.MessageID, "wrong", got.Timestamp) {
+		t.Errorf("request not signed with client key")
+	}
+}
+
+func TestDeviceError(t *testing.T) {
+	d := refosstest.NewDevice("uuid", "key")
+	defer d.Close()
+
+	d.FailWith(5000)
+	_, err := d.Client().Electricity(context.Background(), 0)
+	var deviceErr *refoss.DeviceError
+	if !errors.As(err, &deviceErr) {
+		t.Fatalf("got %v, want DeviceError", err)
+	}
+	if deviceErr.Code != 5000 || deviceErr.Namespace != refoss.NamespaceElectricity {
+		t.Errorf("got %+v", deviceErr)
+	}
+
+	d.FailWith(0)
+	if _, err := d.Client().Electricity(context.Background(), 0); err != nil {
+		t.Errorf("request after recovery failed: %v", err)
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	_, err := refoss.NewClient(s.URL, "uuid", "key").Electricity(context.Background(), 0)
+	var httpErr *refoss.HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("got %v, want HTTPError", err)
+	}
+	if httpErr.StatusCode != http.StatusServiceUnavailable || httpErr.Body != "busy\n" {
+		t.Errorf("got %+v", httpErr)
+	}
+}
+
+func TestElectricityX(t *testing.T) {
+	d := refosstest.NewDevice("uuid", "key")
+	defer d.Close()
+
+	d.SetPower(1, 100, 230, 0.5)
+	d.SetPower(3, 2000.5, 229.9, 8.7)
+
+	res, err := d.Client().ElectricityX(context.Background(), []int{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("got %d channels, want 3", len(res))
+	}
+
+	tests := []struct {
+		channel            int
+		watts, volts, amps float64
+	}{
+		{1, 100, 230, 0.5},
+		{2, 0, 0, 0},
+		{3, 2000.5, 229.9, 8.7},
+	}
+	for i, tt := range tests {
+		e := res[i]
+		if e.Channel != tt.channel {
+			t.Errorf("channel %d: got channel %d", tt.channel, e.Channel)
+		}
+		if e.Watts() != tt.watts || e.Volts() != tt.volts || e.Amps() != tt.amps {
+			t.Errorf("channel %d: got %vW %vV %vA, want %vW %vV %vA",
+				tt.channel, e.Watts(), e.Volts(), e.Amps(), tt.watts, tt.volts, tt.amps)
+		}
+	}
+}
+
+func TestToggleX(t *testing.T) {
+	d := refosstest.NewDevice("uuid", "key")
+	defer d.Close()
+	c := d.Client()
+
+	for _, on := range []bool{true, false, true} {
+		if err := c.ToggleX(context.Background(), 1, on); err != nil {
+			t.Fatal(err)
+		}
+		if d.On(1) != on {
+			t.Errorf("channel 1: got %v, want %v", d.On(1), on)
+		}
+	}
+	if d.On(0) {
+		t.Errorf("channel 0 switched")
+	}
+
+	all, err := c.SystemAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	toggles := all.All.Digest.ToggleX
+	if len(toggles) != 1 || toggles[0].Channel != 1 || !toggles[0].On() {
+		t.Errorf("got digest %+v", toggles)
+	}
+}
@@ -0,0 +1,31 @@
+package refoss
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidSignature is returned for answers not signed with the client key.
+var ErrInvalidSignature = errors.New("refoss: invalid response signature")
+
+// DeviceError is an ERROR answer of the device, e.g. code 5001 for a wrong
+// signature on our side.
+type DeviceError struct {
+	Namespace string
+	Code      int
+	Detail    string
+}
+
+func (e *DeviceError) Error() string {
+	return fmt.Sprintf("refoss: %s failed: code %d: %s", e.Namespace, e.Code, e.Detail)
+}
+
+// HTTPError is returned for non 2xx HTTP answers.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("refoss: http status %d: %s", e.StatusCode, e.Body)
+}
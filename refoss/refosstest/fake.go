@@ -0,0 +1,182 @@
+// Package refosstest provides a fake Refoss device for offline tests.
+package refosstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/fipso/screen-app/refoss"
+)
+
+// Device answers the local HTTP API like a real plug or energy monitor. All
+// channels referenced by requests exist implicitly.
+type Device struct {
+	Server *httptest.Server
+	UUID   string
+	Key    string
+
+	mu          sync.Mutex
+	electricity map[int]refoss.Electricity
+	onoff       map[int]bool
+	consumption []refoss.Consumption
+	// errorCode makes every request fail with this device error if not 0
+	errorCode int
+	requests  []refoss.Message
+}
+
+// NewDevice starts a fake device. Close it with Close.
+func NewDevice(uuid, key string) *Device {
+	d := &Device{
+		UUID:        uuid,
+		Key:         key,
+		electricity: map[int]refoss.Electricity{},
+		onoff:       map[int]bool{},
+	}
+	d.Server = httptest.NewServer(http.HandlerFunc(d.serve))
+	return d
+}
+
+func (d *Device) Close() {
+	d.Server.Close()
+}
+
+// Client returns a client configured for the device.
+func (d *Device) Client() *refoss.Client {
+	c := refoss.NewClient(d.Server.URL, d.UUID, d.Key)
+	c.HTTPClient = d.Server.Client()
+	return c
+}
+
+// SetPower sets the reading of a channel in W, V and A.
+func (d *Device) SetPower(channel int, watts, volts, amps float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.electricity[channel] = refoss.Electricity{
+		Channel: channel,
+		Power:   int(watts * 1000),
+		Voltage: int(volts * 10),
+		Current: int(amps * 1000),
+	}
+}
+
+func (d *Device) SetConsumption(c []refoss.Consumption) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.consumption = c
+}
+
+func (d *Device) On(channel int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.onoff[channel]
+}
+
+// FailWith makes all following requests fail with a device error code,
+// 0 restores normal operation.
+func (d *Device) FailWith(code int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errorCode = code
+}
+
+// Requests returns all messages received so far.
+func (d *Device) Requests() []refoss.Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]refoss.Message(nil), d.requests...)
+}
+
+func (d *Device) serve(w http.ResponseWriter, r *http.Request) {
+	var req refoss.Message
+	if r.URL.Path != "/config" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests = append(d.requests, req)
+
+	if req.Header.Sign != refoss.Sign(req.Header.MessageID, d.Key, req.Header.Timestamp) {
+		d.answer(w, req, "ERROR", map[string]any{"error": map[string]any{"code": 5001, "detail": "sign error"}})
+		return
+	}
+	if d.errorCode != 0 {
+		d.answer(w, req, "ERROR", map[string]any{"error": map[string]any{"code": d.errorCode, "detail": "fake error"}})
+		return
+	}
+
+	switch req.Header.Namespace {
+	case refoss.NamespaceElectricity:
+		var p struct {
+			Electricity refoss.Electricity `json:"electricity"`
+		}
+		json.Unmarshal(req.Payload, &p)
+		e := d.electricity[p.Electricity.Channel]
+		e.Channel = p.Electricity.Channel
+		d.answer(w, req, "GETACK", map[string]any{"electricity": e})
+
+	case refoss.NamespaceElectricityX:
+		var p struct {
+			Electricity []refoss.Electricity `json:"electricity"`
+		}
+		json.Unmarshal(req.Payload, &p)
+		res := make([]refoss.Electricity, len(p.Electricity))
+		for i, ch := range p.Electricity {
+			res[i] = d.electricity[ch.Channel]
+			res[i].Channel = ch.Channel
+		}
+		d.answer(w, req, "GETACK", map[string]any{"electricity": res})
+
+	case refoss.NamespaceToggleX:
+		var p struct {
+			ToggleX refoss.ToggleX `json:"togglex"`
+		}
+		json.Unmarshal(req.Payload, &p)
+		d.onoff[p.ToggleX.Channel] = p.ToggleX.On()
+		d.answer(w, req, "SETACK", map[string]any{})
+
+	case refoss.NamespaceSystemAll:
+		var all refoss.SystemAll
+		all.All.System.Hardware.UUID = d.UUID
+		all.All.System.Online.Status = 1
+		all.All.System.Time.Timestamp = time.Now().Unix()
+		for channel, on := range d.onoff {
+			t := refoss.ToggleX{Channel: channel}
+			if on {
+				t.Onoff = 1
+			}
+			all.All.Digest.ToggleX = append(all.All.Digest.ToggleX, t)
+		}
+		d.answer(w, req, "GETACK", all)
+
+	case refoss.NamespaceConsumption:
+		d.answer(w, req, "GETACK", map[string]any{"consumptionx": d.consumption})
+
+	default:
+		d.answer(w, req, "ERROR", map[string]any{"error": map[string]any{"code": 5000, "detail": "unknown namespace"}})
+	}
+}
+
+func (d *Device) answer(w http.ResponseWriter, req refoss.Message, method string, payload any) {
+	p, _ := json.Marshal(payload)
+	messageID := refoss.GenerateMessageID()
+	timestamp := time.Now().Unix()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refoss.Message{
+		Header: refoss.Header{
+			MessageID:      messageID,
+			Method:         method,
+			From:           "/appliance/" + d.UUID + "/publish",
+			PayloadVersion: 1,
+			Namespace:      req.Header.Namespace,
+			UUID:           d.UUID,
+			Sign:           refoss.Sign(messageID, d.Key, timestamp),
+			Timestamp:      timestamp,
+		},
+		Payload: p,
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (d *ShellyEnergyDeviceConfig) DeviceID() string {
+	if d.ID != "" {
+		return d.ID
+	}
+	return d.Name
+}
+
+// shellyStatus covers the power fields of Switch, PM1 and EM1 status.
+type shellyStatus struct {
+	ID       int      `json:"id"`
+	APower   *float64 `json:"apower"`
+	ActPower *float64 `json:"act_power"`
+	Voltage  float64  `json:"voltage"`
+	Current  float64  `json:"current"`
+	PF       float64  `json:"pf"`
+}
+
+func (d *ShellyEnergyDeviceConfig) ReadPower(ctx context.Context, channels []int) ([]PowerReading, error) {
+	component := d.Component
+	if component == "" {
+		component = "Switch"
+	}
+	if len(channels) == 0 {
+		channels = []int{0}
+	}
+
+	var res []PowerReading
+	for _, ch := range channels {
+		var status shellyStatus
+		err := d.call(ctx, component+".GetStatus", url.Values{"id": {strconv.Itoa(ch)}}, &status)
+		if err != nil {
+			return nil, err
+		}
+
+		r := PowerReading{Channel: ch, Volts: status.Voltage, Amps: status.Current, Factor: status.PF}
+		switch {
+		case status.APower != nil:
+			r.Watts = *status.APower
+		case status.ActPower != nil:
+			r.Watts = *status.ActPower
+		default:
+			return nil, fmt.Errorf("shelly %s: %s:%d reports no power", d.Name, component, ch)
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func (d *ShellyEnergyDeviceConfig) SetPlugState(on bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	params := url.Values{
+		"id": {strconv.Itoa(d.SwitchChannel)},
+		"on": {strconv.FormatBool(on)},
+	}
+	if err := d.call(ctx, "Switch.Set", params, nil); err != nil {
+		return fmt.Errorf("plug %s set state failed: %w", d.DeviceID(), err)
+	}
+	plugStates.set(d.DeviceID(), on)
+	return nil
+}
+
+func (d *ShellyEnergyDeviceConfig) ReadPlugState(ctx context.Context) (bool, error) {
+	var status struct {
+		Output bool `json:"output"`
+	}
+	params := url.Values{"id": {strconv.Itoa(d.SwitchChannel)}}
+	if err := d.call(ctx, "Switch.GetStatus", params, &status); err != nil {
+		return false, err
+	}
+	return status.Output, nil
+}
+
+// call runs a JSON-RPC method over the HTTP GET interface.
+func (d *ShellyEnergyDeviceConfig) call(ctx context.Context, method string, params url.Values, res any) error {
+	u := strings.TrimSuffix(d.Address, "/") + "/rpc/" + method + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := meterHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var rpcErr struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &rpcErr) == nil && rpcErr.Message != "" {
+			return fmt.Errorf("shelly %s: %s: %s (%d)", d.Name, method, rpcErr.Message, rpcErr.Code)
+		}
+		return fmt.Errorf("shelly %s: %s: http %d", d.Name, method, resp.StatusCode)
+	}
+
+	if res == nil {
+		return nil
+	}
+	return json.Unmarshal(body, res)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type automationSample struct {
+	at    time.Time
+	key   string
+	value float64
+}
+
+// runSimulateAutomations replays recorded values through the automation logic
+// and prints when each automation would have switched. No device is touched.
+func runSimulateAutomations(args []string) {
+	fs := flag.NewFlagSet("simulate-automations", flag.ExitOnError)
+	input := fs.String("input", "", "history csv (timestamp,topic,value) or mqtt recording (timestamp topic payload per line)")
+	format := fs.String("format", "", "input format csv or mqtt, guessed from the file extension if empty")
+	verbose := fs.Bool("v", false, "print automation log output")
+	fs.Parse(args)
+
+	if *input == "" {
+		log.Fatal("simulate-automations: --input is required")
+	}
+	if *format == "" {
+		*format = "mqtt"
+		if strings.EqualFold(filepath.Ext(*input), ".csv") {
+			*format = "csv"
+		}
+	}
+
+	loadConfig()
+
+	f, err := os.Open(*input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	var samples []automationSample
+	switch *format {
+	case "csv":
+		samples, err = readCsvSamples(f)
+	case "mqtt":
+		samples, err = readMqttRecording(f)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatal("simulate-automations: ", err)
+	}
+	if len(samples) == 0 {
+		log.Fatal("simulate-automations: no samples in input")
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].at.Before(samples[j].at)
+	})
+	samples = deriveGrowSamples(samples)
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	s := &AutomationService{simulate: true}
+	s.init(config.Automations, samples[0].at)
+	prev := samples[0].at
+	for _, sample := range samples {
+		advanceSimulation(s, prev, sample.at)
+		prev = sample.at
+
+		s.mu.Lock()
+		for _, st := range s.byTopic[sample.key] {
+			s.evaluate(st, sample.value, sample.at)
+		}
+		for _, st := range s.byInput[sample.key] {
+			s.evaluate(st, sample.value, sample.at)
+		}
+		s.mu.Unlock()
+	}
+	end := samples[len(samples)-1].at
+	s.runPending(end)
+
+	printSimulation(os.Stdout, s, samples[0].at, end)
+}
+
+// advanceSimulation does the periodic work of the live service (watchdog,
+// controllers, deferred switches) for every simulated second in (from, to].
+func advanceSimulation(s *AutomationService, from, to time.Time) {
+	for t := from.Truncate(time.Second).Add(time.Second); !t.After(to); t = t.Add(time.Second) {
+		s.runPending(t)
+		s.checkStale(t)
+		s.tick(t)
+	}
+	s.runPending(to)
+}
+
+func readCsvSamples(r io.Reader) ([]automationSample, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+
+	var samples []automationSample
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		at, err := parseSampleTime(record[0])
+		if err != nil {
+			if line == 1 {
+				// Header
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		v, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		samples = append(samples, automationSample{at: at, key: record[1], value: v})
+	}
+
+	return samples, nil
+}
+
+// readMqttRecording reads lines as written by
+// mosquitto_sub -v -F "%U %t %p". Lines with non numeric payloads are skipped.
+func readMqttRecording(r io.Reader) ([]automationSample, error) {
+	var samples []automationSample
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected timestamp, topic and payload", line)
+		}
+
+		at, err := parseSampleTime(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		v, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			continue
+		}
+		samples = append(samples, automationSample{at: at, key: fields[1], value: v})
+	}
+
+	return samples, scanner.Err()
+}
+
+// parseSampleTime accepts RFC3339 or unix seconds with optional fraction.
+func parseSampleTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, errors.New("invalid timestamp " + s)
+	}
+	return time.Unix(0, int64(secs*float64(time.Second))), nil
+}
+
+// deriveGrowSamples adds the temp:, rh: and vpd: inputs of grow sensors to
+// recordings of their raw MQTT topics, like runGrowDerivedValues does live.
+func deriveGrowSamples(samples []automationSample) []automationSample {
+	type growValues struct {
+		temp, rh         float64
+		haveTemp, haveRh bool
+	}
+	values := make([]growValues, len(config.Grow.Sensors))
+
+	var res []automationSample
+	for _, sample := range samples {
+		res = append(res, sample)
+		for i, sensor := range config.Grow.Sensors {
+			v := &values[i]
+			switch sample.key {
+			case sensor.Temp:
+				v.temp, v.haveTemp = sample.value, true
+				res = append(res, automationSample{at: sample.at, key: "temp:" + sensor.Name, value: sample.value})
+			case sensor.Humid:
+				v.rh, v.haveRh = sample.value, true
+				res = append(res, automationSample{at: sample.at, key: "rh:" + sensor.Name, value: sample.value})
+			default:
+				continue
+			}
+			if v.haveTemp && v.haveRh {
+				res = append(res, automationSample{at: sample.at, key: "vpd:" + sensor.Name, value: calculateVPD(v.temp, v.rh)})
+			}
+		}
+	}
+
+	return res
+}
+
+func printSimulation(w io.Writer, s *AutomationService, start, end time.Time) {
+	fmt.Fprintf(w, "simulated %s to %s\n\n", start.Format(time.DateTime), end.Format(time.DateTime))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "time\tautomation\tstate\tcondition")
+	for _, e := range s.events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.at.Format(time.DateTime), e.name, onOff(e.on), triggeredString(e.triggered))
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+
+	names := make([]string, 0, len(s.states))
+	for name := range s.states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(tw, "automation\ttoggles\ton\toff")
+	for _, name := range names {
+		var onTime, offTime time.Duration
+		toggles := -1
+		var last *automationEvent
+		for i := range s.events {
+			e := &s.events[i]
+			if e.name != name {
+				continue
+			}
+			if last != nil {
+				if last.on {
+					onTime += e.at.Sub(last.at)
+				} else {
+					offTime += e.at.Sub(last.at)
+				}
+			}
+			toggles++
+			last = e
+		}
+		if last != nil {
+			if last.on {
+				onTime += end.Sub(last.at)
+			} else {
+				offTime += end.Sub(last.at)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", name, max(toggles, 0), onTime, offTime)
+	}
+	tw.Flush()
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func triggeredString(triggered bool) string {
+	if triggered {
+		return "triggered"
+	}
+	return "released"
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// production sums the latest power of all real producers. Plugs report
+// feed-in as positive or negative depending on the model, so the magnitude
+// is used.
+func (s *EnergyService) production() float64 {
+	watts := 0.0
+	for _, d := range s.devices {
+		if d.expr != nil || !d.producer {
+			continue
+		}
+		v, _ := d.latest()
+		watts += math.Abs(v)
+	}
+	return watts
+}
+
+// net is the power drawn from the grid, negative while feeding in.
+func (s *EnergyService) net() float64 {
+	return s.total() - s.production()
+}
+
+func (s *EnergyService) hasProducers() bool {
+	for _, d := range s.devices {
+		if d.producer {
+			return true
+		}
+	}
+	return false
+}
+
+// SolarDay sums production and consumption since midnight.
+type SolarDay struct {
+	ProducedKWh float64
+	ConsumedKWh float64
+	// Produced energy used in the home instead of being fed in
+	SelfConsumedKWh float64
+}
+
+// SelfConsumption is the share of the production used in the home.
+func (d SolarDay) SelfConsumption() float64 {
+	if d.ProducedKWh == 0 {
+		return 0
+	}
+	return d.SelfConsumedKWh / d.ProducedKWh
+}
+
+// Autarky is the share of the consumption covered by own production.
+func (d SolarDay) Autarky() float64 {
+	if d.ConsumedKWh == 0 {
+		return 0
+	}
+	return d.SelfConsumedKWh / d.ConsumedKWh
+}
+
+// solarDay integrates today's minute averages from the history store, so
+// the numbers survive restarts. Self-consumption is accounted per minute.
+func (s *EnergyService) solarDay(now time.Time) SolarDay {
+	from := startOfDay(now)
+	consumed := map[int64]float64{}
+	produced := map[int64]float64{}
+
+	minuteAvgs := func(d *EnergySensorState) map[int64]float64 {
+		res := map[int64]float64{}
+		for _, p := range queryHistory(d.historySeries(), from, now, time.Minute) {
+			res[p.Time.Unix()] = p.Avg
+		}
+		return res
+	}
+
+	for _, d := range s.devices {
+		if d.expr != nil {
+			continue
+		}
+		for minute, v := range minuteAvgs(d) {
+			if d.producer {
+				produced[minute] += math.Abs(v)
+			} else {
+				consumed[minute] += v
+			}
+		}
+		// Aggregates are linear, so they apply to the averages as well
+		if d.producer {
+			continue
+		}
+		for _, aggr := range d.aggrInputs {
+			for minute, v := range minuteAvgs(aggr.state) {
+				switch aggr.op {
+				case AggrOpAdd:
+					consumed[minute] += v
+				case AggrOpSub:
+					consumed[minute] -= v
+				}
+			}
+		}
+	}
+
+	var day SolarDay
+	hours := time.Minute.Hours()
+	for minute, c := range consumed {
+		c = math.Max(0, c)
+		day.ConsumedKWh += c * hours / 1000
+		day.SelfConsumedKWh += math.Min(c, produced[minute]) * hours / 1000
+	}
+	for _, p := range produced {
+		day.ProducedKWh += p * hours / 1000
+	}
+	return day
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/hajimehoshi/ebiten/v2/audio"
+	"github.com/hajimehoshi/ebiten/v2/audio/mp3"
+)
+
+// ebiten only allows a single audio context per process
+var (
+	audioContext     *audio.Context
+	audioContextOnce sync.Once
+)
+
+func playSound(path string) error {
+	audioContextOnce.Do(func() {
+		audioContext = audio.NewContext(44100)
+	})
+
+	soundFileReader, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	stream, err := mp3.DecodeWithSampleRate(44100, soundFileReader)
+	if err != nil {
+		return err
+	}
+	player, err := audioContext.NewPlayer(stream)
+	if err != nil {
+		return err
+	}
+	player.SetVolume(1)
+	player.Play()
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import "sync"
+
+// Observable hands data from poller goroutines to the render loop. Writers
+// publish a new snapshot with Set or Update, readers get the latest snapshot
+// with Get. Snapshots are shared and must not be modified after publishing,
+// build a new value instead (appending to a slice is fine, readers only see
+// their own length).
+//
+// Every publish bumps the version, so widgets can skip work if nothing
+// changed since they last looked.
+type Observable[T any] struct {
+	mu       sync.RWMutex
+	value    T
+	version  uint64
+	handlers []func(T)
+}
+
+func (o *Observable[T]) Set(value T) {
+	o.Update(func(T) T { return value })
+}
+
+// Update publishes fn(current). fn runs under the write lock, so concurrent
+// updates are not lost.
+func (o *Observable[T]) Update(fn func(T) T) {
+	o.mu.Lock()
+	o.value = fn(o.value)
+	o.version++
+	value := o.value
+	hs := o.handlers
+	o.mu.Unlock()
+
+	for _, h := range hs {
+		h(value)
+	}
+}
+
+func (o *Observable[T]) Get() T {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.value
+}
+
+// Snapshot returns the latest value and its version. Version 0 means
+// nothing was published yet.
+func (o *Observable[T]) Snapshot() (T, uint64) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.value, o.version
+}
+
+func (o *Observable[T]) Version() uint64 {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.version
+}
+
+// OnChange calls handler with every new snapshot, on the writer goroutine.
+func (o *Observable[T]) OnChange(handler func(T)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.handlers = append(o.handlers, handler)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// price returns the price per kWh at t.
+func (t TariffConfig) price(at time.Time) float64 {
+	if p, ok := priceService.at(at); ok {
+		return p
+	}
+	for _, w := range t.Windows {
+		if w.contains(at) {
+			return w.PricePerKWh
+		}
+	}
+	return t.PricePerKWh
+}
+
+// baseFeePerDay spreads the monthly base fee over the days of the month.
+func (t TariffConfig) baseFeePerDay(day time.Time) float64 {
+	days := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, day.Location()).Day()
+	return t.BaseFeePerMonth / float64(days)
+}
+
+func (w TimeWindow) contains(at time.Time) bool {
+	if len(w.Days) > 0 {
+		day := strings.ToLower(at.Weekday().String()[:3])
+		found := false
+		for _, d := range w.Days {
+			if strings.ToLower(d) == day {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	start, ok1 := parseClock(w.Start)
+	end, ok2 := parseClock(w.End)
+	if !ok1 || !ok2 {
+		return false
+	}
+	now := at.Hour()*60 + at.Minute()
+	if start <= end {
+		return now >= start && now < end
+	}
+	// Wraps around midnight
+	return now >= start || now < end
+}
+
+// parseClock parses "15:04" into minutes since midnight.
+func parseClock(s string) (int, bool) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// tasmotaDevice adds the state of MQTT telemetry to the configuration.
+type tasmotaDevice struct {
+	*TasmotaEnergyDeviceConfig
+	pushed pushedPower
+}
+
+// tasmotaEnergy is the ENERGY object of Tasmota sensor telemetry. Devices
+// with several relays report arrays instead of numbers.
+type tasmotaEnergy struct {
+	Power   json.RawMessage
+	Voltage json.RawMessage
+	Current json.RawMessage
+	Factor  json.RawMessage
+}
+
+func (d *tasmotaDevice) DeviceID() string {
+	if d.ID != "" {
+		return d.ID
+	}
+	return d.Name
+}
+
+func (d *tasmotaDevice) start() {
+	if d.Topic == "" {
+		return
+	}
+	go func() {
+		mqttService.WaitReady()
+		mqttService.On("tele/"+d.Topic+"/SENSOR", func(client mqtt.Client, msg mqtt.Message) {
+			var sensor struct {
+				ENERGY *tasmotaEnergy
+			}
+			if err := json.Unmarshal(msg.Payload(), &sensor); err != nil {
+				log.Println("Could not parse tasmota telemetry", msg.Topic(), err)
+				return
+			}
+			if sensor.ENERGY == nil {
+				return
+			}
+			d.pushed.set(sensor.ENERGY.readings())
+		})
+	}()
+}
+
+func (d *tasmotaDevice) ReadPower(ctx context.Context, channels []int) ([]PowerReading, error) {
+	if d.Topic != "" {
+		return d.pushed.read(channels)
+	}
+
+	var status struct {
+		StatusSNS struct {
+			ENERGY *tasmotaEnergy
+		}
+	}
+	if err := d.command(ctx, "Status 10", &status); err != nil {
+		return nil, err
+	}
+	if status.StatusSNS.ENERGY == nil {
+		return nil, fmt.Errorf("tasmota %s reports no energy", d.Name)
+	}
+
+	// Reuse the channel lookup of pushed readings
+	var p pushedPower
+	p.set(status.StatusSNS.ENERGY.readings())
+	return p.read(channels)
+}
+
+func (d *tasmotaDevice) SetPlugState(on bool) error {
+	state := "OFF"
+	if on {
+		state = "ON"
+	}
+	power := fmt.Sprintf("POWER%d", d.SwitchChannel+1)
+
+	if d.Topic != "" {
+		return mqttService.Publish("cmnd/"+d.Topic+"/"+power, state, false)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.command(ctx, power+" "+state, nil); err != nil {
+		return fmt.Errorf("plug %s set state failed: %w", d.DeviceID(), err)
+	}
+	return nil
+}
+
+// command runs a console command over the HTTP API.
+func (d *tasmotaDevice) command(ctx context.Context, cmnd string, res any) error {
+	params := url.Values{"cmnd": {cmnd}}
+	if d.Username != "" {
+		params.Set("user", d.Username)
+		params.Set("password", d.Password)
+	}
+	u := strings.TrimSuffix(d.Address, "/") + "/cm?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := meterHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tasmota %s: %s: http %d", d.Name, cmnd, resp.StatusCode)
+	}
+	var warning struct {
+		WARNING string
+		Command string
+	}
+	if json.Unmarshal(body, &warning) == nil {
+		if warning.WARNING != "" {
+			return fmt.Errorf("tasmota %s: %s", d.Name, warning.WARNING)
+		}
+		if warning.Command == "Unknown" {
+			return fmt.Errorf("tasmota %s: unknown command %s", d.Name, cmnd)
+		}
+	}
+
+	if res == nil {
+		return nil
+	}
+	return json.Unmarshal(body, res)
+}
+
+func (e *tasmotaEnergy) readings() []PowerReading {
+	power := tasmotaValues(e.Power)
+	volts := tasmotaValues(e.Voltage)
+	amps := tasmotaValues(e.Current)
+	factor := tasmotaValues(e.Factor)
+
+	res := make([]PowerReading, len(power))
+	for i := range power {
+		res[i] = PowerReading{
+			Channel: i,
+			Watts:   power[i],
+			Volts:   tasmotaValueAt(volts, i),
+			Amps:    tasmotaValueAt(amps, i),
+			Factor:  tasmotaValueAt(factor, i),
+		}
+	}
+	return res
+}
+
+// tasmotaValues decodes a number or an array of numbers.
+func tasmotaValues(raw json.RawMessage) []float64 {
+	var v float64
+	if json.Unmarshal(raw, &v) == nil {
+		return []float64{v}
+	}
+	var vs []float64
+	json.Unmarshal(raw, &vs)
+	return vs
+}
+
+// tasmotaValueAt returns the i-th value, or the only value if all channels
+// share it like the voltage of some devices.
+func tasmotaValueAt(values []float64, i int) float64 {
+	if i < len(values) {
+		return values[i]
+	}
+	if len(values) == 1 {
+		return values[0]
+	}
+	return 0
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/text"
+	"github.com/hajimehoshi/ebiten/v2/vector"
+)
+
+// TimeChart draws time series directly with ebiten/vector. Series are
+// decimated to min/max per pixel column and the image is only redrawn when
+// data, range or theme changed.
+type TimeChart struct {
+	image  *ebiten.Image
+	width  int
+	height int
+
+	mu      sync.Mutex
+	series  []chartSeries
+	dirty   bool
+	theme   ChartTheme
+	yFixed  bool
+	yMin    float64
+	yMax    float64
+	xFrom   time.Time
+	xTo     time.Time
+	yFormat string
+	xFormat string
+
+	vertices []ebiten.Vertex
+	indices  []uint16
+}
+
+type chartSeries struct {
+	name   string
+	times  []time.Time
+	values []float64
+	hidden bool
+	// dimmed series are drawn with reduced alpha, e.g. offline devices
+	dimmed bool
+}
+
+type ChartTheme struct {
+	Background color.RGBA
+	Text       color.RGBA
+	Grid       color.RGBA
+	Palette    []color.RGBA
+}
+
+var chartPalette = []color.RGBA{
+	{0, 116, 217, 255},
+	{46, 204, 64, 255},
+	{255, 65, 54, 255},
+	{255, 133, 27, 255},
+	{177, 13, 201, 255},
+	{57, 204, 204, 255},
+	{240, 18, 190, 255},
+	{133, 20, 75, 255},
+	{1, 255, 112, 255},
+	{255, 220, 0, 255},
+}
+
+// currentChartTheme follows the day/night colors.
+func currentChartTheme() ChartTheme {
+	return ChartTheme{
+		Background: bgColor,
+		Text:       textColor,
+		Grid:       color.RGBA{textColor.R, textColor.G, textColor.B, 40},
+		Palette:    chartPalette,
+	}
+}
+
+const (
+	chartMarginLeft   = 110
+	chartMarginBottom = 50
+	chartMarginTop    = 10
+	chartMarginRight  = 10
+)
+
+var chartWhiteImage = func() *ebiten.Image {
+	img := ebiten.NewImage(3, 3)
+	img.Fill(color.White)
+	return img
+}()
+
+func NewTimeChart(width, height int) *TimeChart {
+	return &TimeChart{
+		image:   ebiten.NewImage(width, height),
+		width:   width,
+		height:  height,
+		dirty:   true,
+		xFormat: "15:04",
+		yFormat: "%.0f",
+	}
+}
+
+// SetSeries replaces the data of the i-th series. times must be sorted. The
+// slices are not copied and must not be modified afterwards.
+func (c *TimeChart) SetSeries(i int, name string, times []time.Time, values []float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.series) <= i {
+		c.series = append(c.series, chartSeries{})
+	}
+	s := &c.series[i]
+	if s.name == name && sameSeriesData(s.times, s.values, times, values) {
+		return
+	}
+	s.name = name
+	s.times = times
+	s.values = values
+	c.dirty = true
+}
+
+// sameSeriesData compares length and ends, which is enough for append-only
+// histories and avoids comparing every point.
+func sameSeriesData(t1 []time.Time, v1 []float64, t2 []time.Time, v2 []float64) bool {
+	if len(t1) != len(t2) || len(v1) != len(v2) {
+		return false
+	}
+	if len(t1) == 0 {
+		return true
+	}
+	n := len(t1) - 1
+	return t1[0].Equal(t2[0]) && t1[n].Equal(t2[n]) && v1[0] == v2[0] && v1[n] == v2[n]
+}
+
+func (c *TimeChart) SetHidden(i int, hidden bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i < len(c.series) && c.series[i].hidden != hidden {
+		c.series[i].hidden = hidden
+		c.dirty = true
+	}
+}
+
+func (c *TimeChart) SetDimmed(i int, dimmed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i < len(c.series) && c.series[i].dimmed != dimmed {
+		c.series[i].dimmed = dimmed
+		c.dirty = true
+	}
+}
+
+// SetYRange fixes the Y axis. AutoScaleY reverts to fitting the data.
+func (c *TimeChart) SetYRange(min, max float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.yFixed || c.yMin != min || c.yMax != max {
+		c.yFixed, c.yMin, c.yMax = true, min, max
+		c.dirty = true
+	}
+}
+
+func (c *TimeChart) AutoScaleY() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.yFixed {
+		c.yFixed = false
+		c.dirty = true
+	}
+}
+
+// SetTimeRange fixes the X axis, zero times fit the data.
+func (c *TimeChart) SetTimeRange(from, to time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.xFrom.Equal(from) || !c.xTo.Equal(to) {
+		c.xFrom, c.xTo = from, to
+		c.dirty = true
+	}
+}
+
+// SetFormats sets the tick label formats, a time layout for X and a printf
+// verb for Y.
+func (c *TimeChart) SetFormats(xFormat, yFormat string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.xFormat, c.yFormat = xFormat, yFormat
+	c.dirty = true
+}
+
+// Draw renders the chart into c.image if anything changed and returns it.
+func (c *TimeChart) Draw() *ebiten.Image {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	theme := currentChartTheme()
+	if !c.dirty && theme.Background == c.theme.Background && theme.Text == c.theme.Text {
+		return c.image
+	}
+	c.theme = theme
+	c.dirty = false
+
+	c.image.Fill(theme.Background)
+
+	xFrom, xTo := c.timeRange()
+	yMin, yMax := c.valueRange(xFrom, xTo)
+	plotW := float64(c.width - chartMarginLeft - chartMarginRight)
+	plotH := float64(c.height - chartMarginTop - chartMarginBottom)
+
+	toX := func(t time.Time) float64 {
+		span := xTo.Sub(xFrom)
+		if span <= 0 {
+			return chartMarginLeft
+		}
+		return chartMarginLeft + float64(t.Sub(xFrom))/float64(span)*plotW
+	}
+	toY := func(v float64) float64 {
+		return chartMarginTop + (1-(v-yMin)/(yMax-yMin))*plotH
+	}
+
+	c.drawAxes(xFrom, xTo, yMin, yMax, toX, toY)
+
+	for i, s := range c.series {
+		if s.hidden || len(s.times) == 0 {
+			continue
+		}
+		col := theme.Palette[i%len(theme.Palette)]
+		if s.dimmed {
+			col.A = 70
+		}
+		c.drawSeries(s, col, xFrom, xTo, plotW, toY)
+	}
+
+	c.drawLegend()
+
+	return c.image
+}
+
+func (c *TimeChart) timeRange() (time.Time, time.Time) {
+	from, to := c.xFrom, c.xTo
+	for _, s := range c.series {
+		if s.hidden || len(s.times) == 0 {
+			continue
+		}
+		if c.xFrom.IsZero() && (from.IsZero() || s.times[0].Before(from)) {
+			from = s.times[0]
+		}
+		if c.xTo.IsZero() && (to.IsZero() || s.times[len(s.times)-1].After(to)) {
+			to = s.times[len(s.times)-1]
+		}
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() || !from.Before(to) {
+		from = to.Add(-time.Hour)
+	}
+	return from, to
+}
+
+func (c *TimeChart) valueRange(from, to time.Time) (float64, float64) {
+	if c.yFixed && c.yMax > c.yMin {
+		return c.yMin, c.yMax
+	}
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, s := range c.series {
+		if s.hidden {
+			continue
+		}
+		for j, t := range s.times {
+			if t.Before(from) || t.After(to) {
+				continue
+			}
+			lo = math.Min(lo, s.values[j])
+			hi = math.Max(hi, s.values[j])
+		}
+	}
+	if math.IsInf(lo, 0) {
+		return 0, 1
+	}
+	// Power charts read best with zero in view
+	if lo > 0 {
+		lo = 0
+	}
+	if hi <= lo {
+		hi = lo + 1
+	}
+	step := niceStep((hi - lo) / 5)
+	return math.Floor(lo/step) * step, math.Ceil(hi/step) * step
+}
+
+// niceStep rounds a tick distance to 1, 2 or 5 times a power of ten.
+func niceStep(raw float64) float64 {
+	if raw <= 0 {
+		return 1
+	}
+	exp := math.Pow(10, math.Floor(math.Log10(raw)))
+	switch f := raw / exp; {
+	case f <= 1:
+		return exp
+	case f <= 2:
+		return 2 * exp
+	case f <= 5:
+		return 5 * exp
+	}
+	return 10 * exp
+}
+
+func (c *TimeChart) drawAxes(xFrom, xTo time.Time, yMin, yMax float64, toX func(time.Time) float64, toY func(float64) float64) {
+	theme := c.theme
+	left := float32(chartMarginLeft)
+	right := float32(c.width - chartMarginRight)
+	bottom := float32(c.height - chartMarginBottom)
+
+	// Y ticks
+	step := niceStep((yMax - yMin) / 5)
+	for v := yMin; v <= yMax+step/2; v += step {
+		y := float32(toY(v))
+		vector.StrokeLine(c.image, left, y, right, y, 1, theme.Grid, false)
+		label := fmt.Sprintf(c.yFormat, v)
+		bounds := text.BoundString(tinyFont, label)
+		text.Draw(c.image, label, tinyFont, chartMarginLeft-bounds.Dx()-10, int(y)+bounds.Dy()/2, theme.Text)
+	}
+
+	// X ticks
+	span := xTo.Sub(xFrom)
+	tick := niceTimeStep(span / 6)
+	for t := xFrom.Truncate(tick).Add(tick); t.Before(xTo); t = t.Add(tick) {
+		x := float32(toX(t))
+		vector.StrokeLine(c.image, x, float32(chartMarginTop), x, bottom, 1, theme.Grid, false)
+		label := t.Format(c.xFormat)
+		bounds := text.BoundString(tinyFont, label)
+		text.Draw(c.image, label, tinyFont, int(x)-bounds.Dx()/2, c.height-10, theme.Text)
+	}
+
+	vector.StrokeLine(c.image, left, float32(chartMarginTop), left, bottom, 2, theme.Text, false)
+	vector.StrokeLine(c.image, left, bottom, right, bottom, 2, theme.Text, false)
+}
+
+func niceTimeStep(raw time.Duration) time.Duration {
+	for _, d := range []time.Duration{
+		time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+		time.Hour, 2 * time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+	} {
+		if d >= raw {
+			return d
+		}
+	}
+	return 24 * time.Hour * time.Duration(math.Ceil(raw.Hours()/24))
+}
+
+// drawSeries decimates s to one min/max pair per pixel column and strokes
+// the result as a single path.
+func (c *TimeChart) drawSeries(s chartSeries, col color.RGBA, xFrom, xTo time.Time, plotW float64, toY func(float64) float64) {
+	columns := int(plotW)
+	span := float64(xTo.Sub(xFrom))
+	if columns <= 0 || span <= 0 {
+		return
+	}
+
+	var path vector.Path
+	started := false
+	column := -1
+	var first, last, lo, hi float64
+
+	flush := func() {
+		if column < 0 {
+			return
+		}
+		x := float32(chartMarginLeft + column)
+		if !started {
+			path.MoveTo(x, float32(toY(first)))
+			started = true
+		} else {
+			path.LineTo(x, float32(toY(first)))
+		}
+		if hi != lo {
+			path.LineTo(x, float32(toY(hi)))
+			path.LineTo(x, float32(toY(lo)))
+		}
+		path.LineTo(x, float32(toY(last)))
+	}
+
+	for j, t := range s.times {
+		if t.Before(xFrom) || t.After(xTo) {
+			continue
+		}
+		v := s.values[j]
+		columnAt := min(int(float64(t.Sub(xFrom))/span*plotW), columns-1)
+		if columnAt != column {
+			flush()
+			column = columnAt
+			first, last, lo, hi = v, v, v, v
+			continue
+		}
+		last = v
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	flush()
+	if !started {
+		return
+	}
+
+	c.vertices, c.indices = path.AppendVerticesAndIndicesForStroke(c.vertices[:0], c.indices[:0], &vector.StrokeOptions{
+		Width:    2,
+		LineJoin: vector.LineJoinRound,
+	})
+	for i := range c.vertices {
+		c.vertices[i].SrcX = 1
+		c.vertices[i].SrcY = 1
+		c.vertices[i].ColorR = float32(col.R) / 255
+		c.vertices[i].ColorG = float32(col.G) / 255
+		c.vertices[i].ColorB = float32(col.B) / 255
+		c.vertices[i].ColorA = float32(col.A) / 255
+	}
+	c.image.DrawTriangles(c.vertices, c.indices, chartWhiteImage, &ebiten.DrawTrianglesOptions{
+		AntiAlias: true,
+	})
+}
+
+func (c *TimeChart) drawLegend() {
+	size := tinyFont.Metrics().Height.Ceil()
+	x := chartMarginLeft + 20
+	y := chartMarginTop + 20 + size
+	for i, s := range c.series {
+		if s.name == "" {
+			continue
+		}
+		col := c.theme.Palette[i%len(c.theme.Palette)]
+		textCol := c.theme.Text
+		if s.hidden || s.dimmed {
+			col.A = 70
+			textCol.A = 110
+		}
+		vector.DrawFilledRect(c.image, float32(x), float32(y-size), float32(size), float32(size), col, false)
+		text.Draw(c.image, s.name, tinyFont, x+size+8, y, textCol)
+		y += size + 8
+	}
+}
+
+// LegendAt returns the series whose legend entry is at x, y in chart
+// coordinates and whether the point is on its color swatch, or -1.
+func (c *TimeChart) LegendAt(x, y int) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := tinyFont.Metrics().Height.Ceil()
+	left := chartMarginLeft + 20
+	bottom := chartMarginTop + 20 + size
+	for i, s := range c.series {
+		if s.name == "" {
+			continue
+		}
+		width := size + 8 + text.BoundString(tinyFont, s.name).Dx()
+		if x >= left && x < left+width && y >= bottom-size-4 && y < bottom+4 {
+			return i, x < left+size+4
+		}
+		bottom += size + 8
+	}
+	return -1, false
+}
@@ -0,0 +1,471 @@
+// Package tsdb is a small embedded append-only time-series store. Raw
+// samples and downsampled min/max/avg buckets are kept in one file per
+// series, tier and day, so retention is a matter of deleting old files.
+package tsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tier is a resolution level. Step 0 stores raw samples.
+type Tier struct {
+	Step      time.Duration
+	Retention time.Duration
+}
+
+// DefaultTiers keep raw data for two days, minutes for a month and hours for
+// two years.
+var DefaultTiers = []Tier{
+	{Step: 0, Retention: 48 * time.Hour},
+	{Step: time.Minute, Retention: 35 * 24 * time.Hour},
+	{Step: time.Hour, Retention: 2 * 365 * 24 * time.Hour},
+}
+
+// Point is a sample or a bucket. For raw samples Min, Max and Avg are equal
+// and Count is 1.
+type Point struct {
+	Time  time.Time
+	Min   float64
+	Max   float64
+	Avg   float64
+	Count int64
+}
+
+type Store struct {
+	dir   string
+	tiers []Tier
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	dir     string
+	files   []*tierFile // one per tier
+	buckets []*bucket   // open bucket per tier, nil for raw
+}
+
+type tierFile struct {
+	day string
+	f   *os.File
+	w   *bufio.Writer
+}
+
+// bucket is the open bucket of a tier. Flush persists the part added since
+// the last flush, the parts are merged again when reading.
+type bucket struct {
+	start         time.Time
+	min, max, sum float64
+	count         int64
+
+	flushedSum   float64
+	flushedCount int64
+}
+
+const (
+	rawRecordSize    = 16
+	bucketRecordSize = 40
+)
+
+// Open opens or creates a store in dir. Tiers must be sorted by step and
+// start with the raw tier.
+func Open(dir string, tiers []Tier) (*Store, error) {
+	if len(tiers) == 0 || tiers[0].Step != 0 {
+		return nil, errors.New("tsdb: first tier must be raw")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, tiers: tiers, series: map[string]*series{}}, nil
+}
+
+var unsafeChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+func (s *Store) seriesDir(name string) string {
+	return filepath.Join(s.dir, unsafeChars.ReplaceAllString(name, "_"))
+}
+
+// getSeries returns the series, creating it if it does not exist.
+func (s *Store) getSeries(name string) (*series, error) {
+	if sr, ok := s.series[name]; ok {
+		return sr, nil
+	}
+	dir := s.seriesDir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	sr := &series{
+		dir:     dir,
+		files:   make([]*tierFile, len(s.tiers)),
+		buckets: make([]*bucket, len(s.tiers)),
+	}
+	s.series[name] = sr
+	return sr, nil
+}
+
+func tierName(t Tier) string {
+	if t.Step == 0 {
+		return "raw"
+	}
+	return fmt.Sprintf("%ds", int64(t.Step/time.Second))
+}
+
+func dayKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// Append adds a sample. Samples should arrive in time order per series.
+func (s *Store) Append(name string, at time.Time, v float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sr, err := s.getSeries(name)
+	if err != nil {
+		return err
+	}
+
+	if err := s.write(sr, 0, at, Point{Time: at, Min: v, Max: v, Avg: v, Count: 1}); err != nil {
+		return err
+	}
+
+	for i := 1; i < len(s.tiers); i++ {
+		start := at.Truncate(s.tiers[i].Step)
+		b := sr.buckets[i]
+		if b != nil && !b.start.Equal(start) {
+			if err := s.flushBucket(sr, i); err != nil {
+				return err
+			}
+			b = nil
+		}
+		if b == nil {
+			b = &bucket{start: start, min: v, max: v}
+			sr.buckets[i] = b
+		}
+		b.min = math.Min(b.min, v)
+		b.max = math.Max(b.max, v)
+		b.sum += v
+		b.count++
+	}
+
+	return nil
+}
+
+// unflushed returns the part of the bucket not written yet.
+func (b *bucket) unflushed() (Point, bool) {
+	count := b.count - b.flushedCount
+	if count == 0 {
+		return Point{}, false
+	}
+	return Point{
+		Time:  b.start,
+		Min:   b.min,
+		Max:   b.max,
+		Avg:   (b.sum - b.flushedSum) / float64(count),
+		Count: count,
+	}, true
+}
+
+// flushBucket writes the unflushed part of the open bucket of a tier.
+func (s *Store) flushBucket(sr *series, tier int) error {
+	b := sr.buckets[tier]
+	if b == nil {
+		return nil
+	}
+	p, ok := b.unflushed()
+	if !ok {
+		return nil
+	}
+	if err := s.write(sr, tier, b.start, p); err != nil {
+		return err
+	}
+	b.flushedSum = b.sum
+	b.flushedCount = b.count
+	return nil
+}
+
+// write appends a record to the day file of a tier, rolling over to a new
+// file and pruning old ones when the day changes.
+func (s *Store) write(sr *series, tier int, at time.Time, p Point) error {
+	day := dayKey(at)
+	tf := sr.files[tier]
+	if tf == nil || tf.day != day {
+		if tf != nil {
+			tf.close()
+		}
+		f, err := openDayFile(filepath.Join(sr.dir, tierName(s.tiers[tier])+"-"+day+".bin"), recordSize(tier))
+		if err != nil {
+			sr.files[tier] = nil
+			return err
+		}
+		tf = &tierFile{day: day, f: f, w: bufio.NewWriter(f)}
+		sr.files[tier] = tf
+		s.prune(sr, tier, at)
+	}
+
+	var buf [bucketRecordSize]byte
+	binary.LittleEndian.PutUint64(buf[0:], uint64(p.Time.UnixNano()))
+	if tier == 0 {
+		binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(p.Avg))
+		_, err := tf.w.Write(buf[:rawRecordSize])
+		return err
+	}
+	binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(p.Min))
+	binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(p.Max))
+	binary.LittleEndian.PutUint64(buf[24:], math.Float64bits(p.Avg*float64(p.Count)))
+	binary.LittleEndian.PutUint64(buf[32:], uint64(p.Count))
+	_, err := tf.w.Write(buf[:bucketRecordSize])
+	return err
+}
+
+func recordSize(tier int) int64 {
+	if tier == 0 {
+		return rawRecordSize
+	}
+	return bucketRecordSize
+}
+
+// openDayFile opens a day file for appending. A torn last record left by a
+// crash is cut off first, otherwise every later record would be misaligned.
+func openDayFile(path string, size int64) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if torn := info.Size() % size; torn != 0 {
+		if err := f.Truncate(info.Size() - torn); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (tf *tierFile) close() {
+	tf.w.Flush()
+	tf.f.Close()
+}
+
+// prune deletes day files of a tier that are entirely past its retention.
+func (s *Store) prune(sr *series, tier int, now time.Time) {
+	prefix := tierName(s.tiers[tier]) + "-"
+	cutoff := dayKey(now.Add(-s.tiers[tier].Retention))
+	for _, file := range s.dayFiles(sr, tier) {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), prefix), ".bin")
+		if day < cutoff {
+			os.Remove(file)
+		}
+	}
+}
+
+func (s *Store) dayFiles(sr *series, tier int) []string {
+	files, _ := filepath.Glob(filepath.Join(sr.dir, tierName(s.tiers[tier])+"-*.bin"))
+	sort.Strings(files)
+	return files
+}
+
+// Flush writes buffered samples and open buckets to disk.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, sr := range s.series {
+		for i := range sr.buckets {
+			if err := s.flushBucket(sr, i); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		for _, tf := range sr.files {
+			if tf == nil {
+				continue
+			}
+			if err := tf.w.Flush(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Close writes open buckets and closes all files. Partial buckets written
+// here are merged with the rest of the bucket on the next run.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sr := range s.series {
+		for i := range sr.buckets {
+			s.flushBucket(sr, i)
+			sr.buckets[i] = nil
+		}
+		for i, tf := range sr.files {
+			if tf != nil {
+				tf.close()
+				sr.files[i] = nil
+			}
+		}
+	}
+	return nil
+}
+
+// Query returns the points of a series in [from, to] using the coarsest tier
+// whose step is at most resolution and whose retention reaches back to from.
+// Resolution 0 asks for raw samples.
+func (s *Store) Query(name string, from, to time.Time, resolution time.Duration) ([]Point, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Reading a series that was never written must not create it
+	if _, ok := s.series[name]; !ok {
+		if _, err := os.Stat(s.seriesDir(name)); errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+	}
+	sr, err := s.getSeries(name)
+	if err != nil {
+		return nil, err
+	}
+	tier := s.pickTier(from, resolution)
+
+	if tf := sr.files[tier]; tf != nil {
+		if err := tf.w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	var points []Point
+	prefix := tierName(s.tiers[tier]) + "-"
+	firstDay, lastDay := dayKey(from.Add(-s.tiers[tier].Step)), dayKey(to)
+	for _, file := range s.dayFiles(sr, tier) {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), prefix), ".bin")
+		if day < firstDay || day > lastDay {
+			continue
+		}
+		ps, err := readFile(file, tier == 0)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, ps...)
+	}
+	if b := sr.buckets[tier]; b != nil {
+		if p, ok := b.unflushed(); ok {
+			points = append(points, p)
+		}
+	}
+
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+	if tier != 0 {
+		points = mergeBuckets(points)
+	}
+
+	res := points[:0]
+	for _, p := range points {
+		if !p.Time.Before(from) && !p.Time.After(to) {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+func (s *Store) pickTier(from time.Time, resolution time.Duration) int {
+	age := time.Since(from)
+	tier := -1
+	for i, t := range s.tiers {
+		if t.Step <= resolution && t.Retention >= age {
+			tier = i
+		}
+	}
+	if tier >= 0 {
+		return tier
+	}
+	// Nothing fits, use the tier reaching back the furthest
+	for i, t := range s.tiers {
+		if tier < 0 || t.Retention > s.tiers[tier].Retention {
+			tier = i
+		}
+	}
+	return tier
+}
+
+// mergeBuckets combines buckets with the same start, written partially
+// before a restart. points must be sorted.
+func mergeBuckets(points []Point) []Point {
+	res := points[:0]
+	for _, p := range points {
+		if n := len(res); n > 0 && res[n-1].Time.Equal(p.Time) {
+			last := &res[n-1]
+			count := last.Count + p.Count
+			last.Avg = (last.Avg*float64(last.Count) + p.Avg*float64(p.Count)) / float64(count)
+			last.Min = math.Min(last.Min, p.Min)
+			last.Max = math.Max(last.Max, p.Max)
+			last.Count = count
+			continue
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+func readFile(path string, raw bool) ([]Point, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size := bucketRecordSize
+	if raw {
+		size = rawRecordSize
+	}
+
+	var points []Point
+	r := bufio.NewReader(f)
+	buf := make([]byte, size)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			// A truncated last record after a crash is ignored
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+
+		t := time.Unix(0, int64(binary.LittleEndian.Uint64(buf[0:])))
+		if raw {
+			v := math.Float64frombits(binary.LittleEndian.Uint64(buf[8:]))
+			points = append(points, Point{Time: t, Min: v, Max: v, Avg: v, Count: 1})
+			continue
+		}
+		count := int64(binary.LittleEndian.Uint64(buf[32:]))
+		if count == 0 {
+			continue
+		}
+		points = append(points, Point{
+			Time:  t,
+			Min:   math.Float64frombits(binary.LittleEndian.Uint64(buf[8:])),
+			Max:   math.Float64frombits(binary.LittleEndian.Uint64(buf[16:])),
+			Avg:   math.Float64frombits(binary.LittleEndian.Uint64(buf[24:])) / float64(count),
+			Count: count,
+		})
+	}
+	return points, nil
+}
@@ -0,0 +1,173 @@
+package tsdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTest(t *testing.T, dir string) *Store {
+	t.Helper()
+	s, err := Open(dir, DefaultTiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func appendAll(t *testing.T, s *Store, start time.Time, step time.Duration, values ...float64) {
+	t.Helper()
+	for i, v := range values {
+		if err := s.Append("power", start.Add(time.Duration(i)*step), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func query(t *testing.T, s *Store, from, to time.Time, resolution time.Duration) []Point {
+	t.Helper()
+	points, err := s.Query("power", from, to, resolution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return points
+}
+
+func checkBucket(t *testing.T, p Point, start time.Time, min, max, avg float64, count int64) {
+	t.Helper()
+	if !p.Time.Equal(start) || p.Min != min || p.Max != max || p.Avg != avg || p.Count != count {
+		t.Errorf("got %+v, want %s min %v max %v avg %v count %d", p, start, min, max, avg, count)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+
+	s := openTest(t, dir)
+	// Two samples per minute over three minutes
+	appendAll(t, s, start, 30*time.Second, 10, 20, 30, 50, 0, 100)
+
+	raw := query(t, s, start, start.Add(time.Hour), 0)
+	if len(raw) != 6 {
+		t.Fatalf("got %d raw samples, want 6", len(raw))
+	}
+	for i, want := range []float64{10, 20, 30, 50, 0, 100} {
+		if raw[i].Avg != want || !raw[i].Time.Equal(start.Add(time.Duration(i)*30*time.Second)) {
+			t.Errorf("sample %d: got %+v, want %v", i, raw[i], want)
+		}
+	}
+
+	minutes := query(t, s, start, start.Add(time.Hour), time.Minute)
+	if len(minutes) != 3 {
+		t.Fatalf("got %d minute buckets, want 3", len(minutes))
+	}
+	checkBucket(t, minutes[0], start, 10, 20, 15, 2)
+	checkBucket(t, minutes[1], start.Add(time.Minute), 30, 50, 40, 2)
+	// The open bucket is included without being flushed
+	checkBucket(t, minutes[2], start.Add(2*time.Minute), 0, 100, 50, 2)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything is read back from disk after a restart
+	s = openTest(t, dir)
+	defer s.Close()
+	if got := len(query(t, s, start, start.Add(time.Hour), 0)); got != 6 {
+		t.Errorf("got %d raw samples after restart, want 6", got)
+	}
+	minutes = query(t, s, start, start.Add(time.Hour), time.Minute)
+	if len(minutes) != 3 {
+		t.Fatalf("got %d minute buckets after restart, want 3", len(minutes))
+	}
+	checkBucket(t, minutes[2], start.Add(2*time.Minute), 0, 100, 50, 2)
+}
+
+func TestPartialBucketsMerge(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+
+	s := openTest(t, dir)
+	appendAll(t, s, start, time.Second, 10, 20)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, s, start.Add(10*time.Second), time.Second, 30, 40)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same minute continues after a restart
+	s = openTest(t, dir)
+	defer s.Close()
+	appendAll(t, s, start.Add(20*time.Second), time.Second, 0, 140)
+
+	minutes := query(t, s, start, start.Add(time.Hour), time.Minute)
+	if len(minutes) != 1 {
+		t.Fatalf("got %d minute buckets, want 1: %+v", len(minutes), minutes)
+	}
+	checkBucket(t, minutes[0], start, 0, 140, 40, 6)
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	minutes = query(t, s, start, start.Add(time.Hour), time.Minute)
+	if len(minutes) != 1 {
+		t.Fatalf("got %d minute buckets after flush, want 1", len(minutes))
+	}
+	checkBucket(t, minutes[0], start, 0, 140, 40, 6)
+}
+
+func TestTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+
+	s := openTest(t, dir)
+	appendAll(t, s, start, time.Second, 1, 2, 3)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of a write leaves half a record
+	path := filepath.Join(dir, "power", "raw-"+dayKey(start)+".bin")
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3, 4, 5})
+	f.Close()
+
+	s = openTest(t, dir)
+	defer s.Close()
+	appendAll(t, s, start.Add(10*time.Second), time.Second, 4, 5)
+
+	raw := query(t, s, start, start.Add(time.Hour), 0)
+	if len(raw) != 5 {
+		t.Fatalf("got %d raw samples, want 5: %+v", len(raw), raw)
+	}
+	for i, want := range []float64{1, 2, 3, 4, 5} {
+		if raw[i].Avg != want {
+			t.Errorf("sample %d: got %v, want %v", i, raw[i].Avg, want)
+		}
+	}
+}
+
+func TestQueryMissingSeries(t *testing.T) {
+	dir := t.TempDir()
+	s := openTest(t, dir)
+
+	now := time.Now()
+	points := query(t, s, now.Add(-time.Hour), now, 0)
+	if len(points) != 0 {
+		t.Errorf("got %d points", len(points))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("query created %s", entries[0].Name())
+	}
+}
@@ -17,7 +17,7 @@ type VPDChart struct {
 	vpdZones    *ebiten.Image
 	width       int
 	height      int
-	sensors     []SensorValue
+	sensors     Observable[[]SensorValue]
 	sensorNames []string
 }
 
@@ -28,23 +28,22 @@ type SensorValue struct {
 
 // NewVPDChart creates a new VPD chart
 func NewVPDChart(width, height int, sensorNames []string) *VPDChart {
-	var sensors []SensorValue
-	for range sensorNames {
-		sensors = append(sensors, SensorValue{})
-	}
-
-	return &VPDChart{
+	chart := &VPDChart{
 		width:       width,
 		height:      height,
 		image:       ebiten.NewImage(width, height),
-		sensors:     sensors,
 		sensorNames: sensorNames,
 	}
+	chart.sensors.Set(make([]SensorValue, len(sensorNames)))
+	return chart
 }
 
 func (v *VPDChart) Update(sensorIndex int, temp, humid float64) {
-	v.sensors[sensorIndex].temp = temp
-	v.sensors[sensorIndex].humid = humid
+	v.sensors.Update(func(old []SensorValue) []SensorValue {
+		sensors := append([]SensorValue(nil), old...)
+		sensors[sensorIndex] = SensorValue{temp: temp, humid: humid}
+		return sensors
+	})
 }
 
 func (v *VPDChart) Draw() {
@@ -58,7 +57,7 @@ func (v *VPDChart) Draw() {
 	v.image.DrawImage(v.vpdZones, nil)
 
 	// Draw markers
-	for i, sensor := range v.sensors {
+	for i, sensor := range v.sensors.Get() {
 		if sensor.humid == 0 || sensor.temp == 0 {
 			continue
 		}
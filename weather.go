@@ -113,8 +113,8 @@ type WeatherUi struct {
 	screen *ebiten.Image
 }
 
-var weatherCurrentData *BrightskyCurrentRes
-var weatherPredictionData *BrightskyPredictionRes
+var weatherCurrentData Observable[*BrightskyCurrentRes]
+var weatherPredictionData Observable[*BrightskyPredictionRes]
 
 func pollWeather() {
 	for {
@@ -149,7 +149,13 @@ func fetchWeatherCurrent() error {
 	if err != nil {
 		return err
 	}
-	weatherCurrentData = &data
+	weatherCurrentData.Set(&data)
+
+	derivedValues.Publish("weather:temperature", data.Weather.Temperature)
+	derivedValues.Publish("weather:humidity", data.Weather.RelativeHumidity)
+	derivedValues.Publish("vpd:outdoor", calculateVPD(data.Weather.Temperature, data.Weather.RelativeHumidity))
+	recordSample("weather.temperature", data.Weather.Timestamp, data.Weather.Temperature)
+	recordSample("weather.humidity", data.Weather.Timestamp, data.Weather.RelativeHumidity)
 
 	return nil
 }
@@ -174,7 +180,7 @@ func fetchWeatherPrediction() error {
 	if err != nil {
 		return err
 	}
-	weatherPredictionData = &data
+	weatherPredictionData.Set(&data)
 
 	return nil
 }
@@ -191,7 +197,8 @@ func (ui *WeatherUi) Bounds() (width, height int) {
 func (ui *WeatherUi) Draw() *ebiten.Image {
 	ui.screen.Fill(bgColor)
 
-	if weatherCurrentData == nil {
+	current := weatherCurrentData.Get()
+	if current == nil {
 		return ui.screen
 	}
 
@@ -207,14 +214,14 @@ func (ui *WeatherUi) Draw() *ebiten.Image {
 	// Draw weather text
 	weatherS := fmt.Sprintf(
 		"%.1f°c\n%s",
-		weatherCurrentData.Weather.Temperature,
-		weatherCurrentData.Weather.Condition,
+		current.Weather.Temperature,
+		current.Weather.Condition,
 	)
 	text.Draw(ui.screen, weatherS, defaultFont, fontWidth*2, fontHeight, textColor)
 	// Draw weather icon
 	text.Draw(
 		ui.screen,
-		icon2Char(weatherCurrentData.Weather.Icon),
+		icon2Char(current.Weather.Icon),
 		weatherFont,
 		fontWidth*6,
 		fontHeight*4,
@@ -223,10 +230,11 @@ func (ui *WeatherUi) Draw() *ebiten.Image {
 
 	// Draw pollen
 	pollenS := ""
+	pollen := pollenStrength.Get()
 	pollenKeys := []string{"g", "b", "h"}
 	for _, key := range pollenKeys {
-		v := pollenStrength[key]
-		if v == "0" {
+		v, ok := pollen[key]
+		if !ok || v == "0" {
 			continue
 		}
 		pollenS += fmt.Sprintf("%s%s\n", key, v)